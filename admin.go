@@ -0,0 +1,244 @@
+package mongo_protocol
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"time"
+)
+
+/*
+管理命令:currentOp, killOp, killAllSessions,数据来自Server的连接与请求注册表;
+本库没有会话的概念,killAllSessions按连接上认证的用户中断请求
+*/
+type Admin struct {
+	Server *Server
+}
+
+func NewAdmin(server *Server) *Admin {
+	return &Admin{Server: server}
+}
+
+func (a *Admin) Register(router *CommandRouter) {
+	router.Handle("currentOp", a.currentOp)
+	router.Handle("killOp", a.killOp)
+	router.Handle("killAllSessions", a.killAllSessions)
+}
+
+/*
+currentOp命令中不作为过滤条件的字段
+*/
+var currentOpOptions = map[string]bool{
+	"currentOp": true, "$all": true, "$ownOps": true, "$db": true, "lsid": true,
+	"$readPreference": true, "$clusterTime": true, "comment": true,
+}
+
+func (a *Admin) currentOp(cmd *Command) (interface{}, error) {
+	doc := cmd.Map()
+	all, _ := doc["$all"].(bool)
+	ownOps, _ := doc["$ownOps"].(bool)
+	filter := bson.M{}
+	for k, v := range doc {
+		if !currentOpOptions[k] {
+			filter[k] = v
+		}
+	}
+	inprog := make([]interface{}, 0)
+	ops := make(map[int64]*Operation)
+	for _, op := range a.Server.Operations() {
+		ops[op.Conn.ID()] = op
+	}
+	for _, conn := range a.Server.Connections() {
+		op := ops[conn.ID]
+		if op == nil && !all {
+			continue
+		}
+		if ownOps && !sameUser(conn.User, cmd.Conn.User()) {
+			continue
+		}
+		entry := operationDocument(conn, op)
+		if matchOperation(entry, filter) {
+			inprog = append(inprog, entry)
+		}
+	}
+	return bson.M{"inprog": inprog, "ok": 1.0}, nil
+}
+
+func (a *Admin) killOp(cmd *Command) (interface{}, error) {
+	id, ok := int64Value(cmd.Map()["op"])
+	if !ok {
+		return nil, NewCommandError(CodeBadValue, "Did not provide \"op\" field")
+	}
+	reply := bson.M{"ok": 1.0}
+	if a.Server.KillOp(id) {
+		reply["info"] = "attempting to kill op"
+	} else {
+		reply["info"] = "operation not found"
+	}
+	return reply, nil
+}
+
+/*
+{killAllSessions: [{user, db}]},列表为空时中断所有连接上的请求(不包括自身)
+*/
+func (a *Admin) killAllSessions(cmd *Command) (interface{}, error) {
+	list, ok := cmd.Map()["killAllSessions"].([]interface{})
+	if !ok {
+		return nil, NewCommandError(CodeTypeMismatch, "killAllSessions must be an array")
+	}
+	users := make([]*AuthenticatedUser, 0, len(list))
+	for _, v := range list {
+		user, ok := v.(bson.M)
+		if !ok {
+			return nil, NewCommandError(CodeTypeMismatch, "killAllSessions entries must be documents")
+		}
+		name, _ := user["user"].(string)
+		db, _ := user["db"].(string)
+		users = append(users, &AuthenticatedUser{User: name, DB: db})
+	}
+	self := cmd.Conn.Operation()
+	for _, op := range a.Server.Operations() {
+		if op == self {
+			continue
+		}
+		if len(users) == 0 || containsUser(users, op.Conn.User()) {
+			op.Kill()
+		}
+	}
+	return bson.M{"ok": 1.0}, nil
+}
+
+/*
+currentOp中的一项,op为nil时表示空闲连接
+*/
+func operationDocument(conn *ConnectionInfo, op *Operation) bson.M {
+	users := make([]interface{}, 0)
+	if conn.User != nil {
+		users = append(users, bson.M{"user": conn.User.User, "db": conn.User.DB})
+	}
+	doc := bson.M{
+		"type":           "op",
+		"desc":           fmt.Sprintf("conn%d", conn.ID),
+		"connectionId":   conn.ID,
+		"client":         conn.RemoteAddr,
+		"active":         op != nil,
+		"effectiveUsers": users,
+	}
+	if conn.Client != nil {
+		doc["appName"] = conn.Client.ApplicationName
+		doc["clientMetadata"] = conn.Client.Raw
+	}
+	if op == nil {
+		return doc
+	}
+	running := time.Since(op.Started)
+	doc["opid"] = op.ID
+	doc["currentOpTime"] = op.Started.Format(time.RFC3339Nano)
+	doc["secs_running"] = int64(running / time.Second)
+	doc["microsecs_running"] = int64(running / time.Microsecond)
+	doc["killPending"] = op.Killed()
+	doc["op"], doc["ns"], doc["command"] = describeOperation(op)
+	return doc
+}
+
+/*
+mongod风格的操作类型,命名空间与命令文档
+*/
+func describeOperation(op *Operation) (string, string, interface{}) {
+	message, e := op.Message(DocumentOrdered)
+	if e != nil {
+		return "none", "", bson.D{}
+	}
+	switch m := message.(type) {
+	case *Msg:
+		body := m.GetBodyMsgSectionD()
+		db, _ := body.Map()["$db"].(string)
+		collection := "$cmd"
+		if len(body) > 0 {
+			if name, ok := body[0].Value.(string); ok {
+				collection = name
+			}
+		}
+		return "command", db + "." + collection, body
+	case *Query:
+		db, collection := splitNamespace(m.FullCollectionName)
+		if collection == "$cmd" {
+			return "command", m.FullCollectionName, m.QueryD
+		}
+		return "query", m.FullCollectionName, bson.D{{Name: "find", Value: collection}, {Name: "filter", Value: m.QueryD}, {Name: "$db", Value: db}}
+	case *Insert:
+		return "insert", m.FullCollectionName, bson.D{}
+	case *Update:
+		return "update", m.FullCollectionName, bson.D{}
+	case *Delete:
+		return "remove", m.FullCollectionName, bson.D{}
+	case *GetMore:
+		return "getmore", m.FullCollectionName, bson.D{}
+	case *KillCursors:
+		return "killcursors", "", bson.D{}
+	}
+	return "none", "", bson.D{}
+}
+
+/*
+按顶层字段相等过滤,数字不区分类型
+*/
+func matchOperation(doc bson.M, filter bson.M) bool {
+	for k, expected := range filter {
+		actual := doc[k]
+		if e, ok := float64Value(expected); ok {
+			if a, ok := float64Value(actual); ok && a == e {
+				continue
+			}
+			return false
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameUser(a, b *AuthenticatedUser) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func containsUser(users []*AuthenticatedUser, user *AuthenticatedUser) bool {
+	for _, v := range users {
+		if sameUser(v, user) {
+			return true
+		}
+	}
+	return false
+}
+
+func int64Value(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func float64Value(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
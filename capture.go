@@ -0,0 +1,219 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+/*
+录制文件格式(小端序):
+
+struct CaptureFile {
+    char[8]  magic = "MONGOCAP";
+    uint32   version = 1;
+    Record*  records;
+};
+
+struct Record {
+    uint8    direction;     // 0 请求, 1 回复
+    int64    timestamp;     // unix纳秒
+    int64    connectionID;
+    byte[]   frame;         // 完整的消息帧(含header,未压缩),长度取自messageLength
+};
+*/
+
+const (
+	captureMagic   = "MONGOCAP"
+	captureVersion = 1
+)
+
+var ErrInvalidCapture = errors.New("invalid capture file")
+
+type CaptureDirection uint8
+
+const (
+	// 客户端发往服务端的请求
+	CaptureRequest CaptureDirection = 0
+	// 服务端写出的回复
+	CaptureReply CaptureDirection = 1
+)
+
+func (d CaptureDirection) String() string {
+	if d == CaptureReply {
+		return "reply"
+	}
+	return "request"
+}
+
+type CaptureRecord struct {
+	Direction    CaptureDirection
+	Time         time.Time
+	ConnectionID int64
+	Header       *MsgHeader
+	// 完整的消息帧,含header
+	Frame []byte
+}
+
+/*
+消息body,不含header
+*/
+func (c *CaptureRecord) Body() []byte {
+	return c.Frame[4*4:]
+}
+
+/*
+解码录制的消息,见ParseMessage
+*/
+func (c *CaptureRecord) Message(mode DocumentMode) (UnMarshaler, error) {
+	return ParseMessage(c.Header, c.Body(), mode)
+}
+
+/*
+写录制文件,可以被多个连接同时使用
+*/
+type CaptureWriter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(captureMagic)
+	_ = binary.Write(buffer, binary.LittleEndian, uint32(captureVersion))
+	if _, e := w.Write(buffer.Bytes()); e != nil {
+		return nil, e
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+func (c *CaptureWriter) Write(record *CaptureRecord) error {
+	return c.WriteFrame(record.Direction, record.Time, record.ConnectionID, record.Frame)
+}
+
+func (c *CaptureWriter) WriteFrame(direction CaptureDirection, t time.Time, connectionID int64, frame []byte) error {
+	buffer := bytes.NewBuffer(make([]byte, 0, 1+8+8+len(frame)))
+	buffer.WriteByte(byte(direction))
+	_ = binary.Write(buffer, binary.LittleEndian, t.UnixNano())
+	_ = binary.Write(buffer, binary.LittleEndian, connectionID)
+	buffer.Write(frame)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, e := c.w.Write(buffer.Bytes())
+	return e
+}
+
+type CaptureReader struct {
+	r io.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	head := make([]byte, len(captureMagic)+4)
+	if _, e := io.ReadFull(r, head); e != nil {
+		return nil, ErrInvalidCapture
+	}
+	if string(head[:len(captureMagic)]) != captureMagic {
+		return nil, ErrInvalidCapture
+	}
+	if version := binary.LittleEndian.Uint32(head[len(captureMagic):]); version != captureVersion {
+		return nil, fmt.Errorf("unsupported capture version %d", version)
+	}
+	return &CaptureReader{r: r}, nil
+}
+
+/*
+读取下一条记录,没有更多记录时返回io.EOF
+*/
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	var direction [1]byte
+	if _, e := io.ReadFull(c.r, direction[:]); e != nil {
+		return nil, e
+	}
+	var prefix struct {
+		Timestamp    int64
+		ConnectionID int64
+	}
+	if e := binary.Read(c.r, binary.LittleEndian, &prefix); e != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header, body, e := readMessage(c.r)
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, e
+	}
+	frame := bytes.NewBuffer(make([]byte, 0, header.MessageLength))
+	_ = binary.Write(frame, binary.LittleEndian, header)
+	frame.Write(body)
+	return &CaptureRecord{
+		Direction:    CaptureDirection(direction[0]),
+		Time:         time.Unix(0, prefix.Timestamp),
+		ConnectionID: prefix.ConnectionID,
+		Header:       header,
+		Frame:        frame.Bytes(),
+	}, nil
+}
+
+/*
+读取全部记录
+*/
+func (c *CaptureReader) ReadAll() ([]*CaptureRecord, error) {
+	records := make([]*CaptureRecord, 0)
+	for {
+		record, e := c.Next()
+		if e == io.EOF {
+			return records, nil
+		}
+		if e != nil {
+			return records, e
+		}
+		records = append(records, record)
+	}
+}
+
+/*
+录制经过的请求与回复,请求在交给next之前写入,回复在写出连接时(压缩前)写入;
+写录制文件失败只记录日志,不影响请求的处理
+*/
+type RecordHandler struct {
+	next    Handler
+	capture *CaptureWriter
+}
+
+func NewRecordHandler(next Handler, capture *CaptureWriter) *RecordHandler {
+	return &RecordHandler{next: next, capture: capture}
+}
+
+func (h *RecordHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	body, e := ioutil.ReadAll(r)
+	if e != nil {
+		return e
+	}
+	frame := bytes.NewBuffer(make([]byte, 0, 4*4+len(body)))
+	request := *header
+	request.MessageLength = int32(4*4 + len(body))
+	_ = binary.Write(frame, binary.LittleEndian, &request)
+	frame.Write(body)
+	h.write(CaptureRequest, conn, frame.Bytes())
+	//每个连接对同一个录制文件只注册一次,之后该连接写出的所有回复(包括Server写出的错误回复)都会被录制
+	key := fmt.Sprintf("record.%p", h.capture)
+	if conn.SetIfAbsent(key, true) {
+		conn.addTap(func(frame []byte) {
+			h.write(CaptureReply, conn, frame)
+		})
+	}
+	return h.next.Process(header, &Reader{Reader: bytes.NewReader(body), Header: header, Mode: r.Mode, MaxDocumentSize: r.MaxDocumentSize}, conn)
+}
+
+func (h *RecordHandler) write(direction CaptureDirection, conn *ConnContext, frame []byte) {
+	if e := h.capture.WriteFrame(direction, time.Now(), conn.ID(), frame); e != nil {
+		logrus.Warnf("[record]write capture error:%v", e)
+	}
+}
@@ -0,0 +1,84 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRecordHandler(t *testing.T) {
+	capture := &bytes.Buffer{}
+	writer, e := NewCaptureWriter(capture)
+	if e != nil {
+		t.Fatal(e)
+	}
+	router := NewCommandRouter()
+	router.Handle("echo", func(cmd *Command) (interface{}, error) {
+		return bson.D{{Name: "value", Value: cmd.Body[1].Value}, {Name: "ok", Value: 1.0}}, nil
+	})
+	server := NewServer(`0`)
+	server.SetDefaultHandler(NewRecordHandler(router, writer))
+	client, conn := net.Pipe()
+	go server.handler(context.TODO(), conn)
+
+	id := bson.ObjectIdHex("5f1d7a3e8c1b2a0001a2b3c4")
+	sendTestMsg(t, client, 7, 0, bson.D{{Name: "echo", Value: 1}, {Name: "id", Value: id}, {Name: "n", Value: int64(42)}, {Name: "$db", Value: "test"}})
+	readTestMsg(t, client)
+	sendTestMsg(t, client, 8, 0, bson.D{{Name: "unknown", Value: 1}, {Name: "$db", Value: "test"}})
+	readTestMsg(t, client)
+	client.Close()
+
+	reader, e := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	records, e := reader.ReadAll()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	for i, record := range records {
+		expected := CaptureDirection(i % 2)
+		if record.Direction != expected || record.ConnectionID != records[0].ConnectionID {
+			t.Fatalf("record %d: unexpected direction %v or connection %d", i, record.Direction, record.ConnectionID)
+		}
+	}
+	if records[1].Header.ResponseTo != 7 || records[3].Header.ResponseTo != 8 {
+		t.Fatalf("unexpected replies %v %v", *records[1].Header, *records[3].Header)
+	}
+	message, e := records[0].Message(DocumentOrdered)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if body := message.(*Msg).GetBodyMsgSectionD(); body[1].Value != id || body[2].Value != int64(42) {
+		t.Fatalf("unexpected request %v", body)
+	}
+
+	out := &bytes.Buffer{}
+	reader, _ = NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if e := ExportJSONLines(reader, out); e != nil {
+		t.Fatal(e)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d", len(lines))
+	}
+	expected := `"body":{"echo":1,"id":{"$oid":"5f1d7a3e8c1b2a0001a2b3c4"},"n":{"$numberLong":42},"$db":"test"}`
+	if !strings.Contains(lines[0], `"direction":"request","opCode":"OP_MSG","requestId":7`) || !strings.Contains(lines[0], expected) {
+		t.Fatalf("unexpected line %s", lines[0])
+	}
+	if !strings.Contains(lines[3], `"codeName":"CommandNotFound"`) {
+		t.Fatalf("unexpected line %s", lines[3])
+	}
+}
+
+func TestCaptureReaderInvalid(t *testing.T) {
+	if _, e := NewCaptureReader(strings.NewReader("not a capture")); e != ErrInvalidCapture {
+		t.Fatalf("expected ErrInvalidCapture, got %v", e)
+	}
+}
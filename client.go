@@ -0,0 +1,237 @@
+package mongo_protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+/*
+可以写出的请求消息,client会为其分配requestID
+*/
+type Request interface {
+	Writer
+	GetHeader() *MsgHeader
+}
+
+type clientResult struct {
+	header  *MsgHeader
+	message UnMarshaler
+	err     error
+}
+
+/*
+简单的线协议客户端,一个连接上可以同时有多个请求,回复按responseTo匹配
+*/
+type Client struct {
+	conn      net.Conn
+	mode      int32
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	pending   map[int32]chan *clientResult
+	err       error
+	done      chan struct{}
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		return nil, e
+	}
+	return NewClient(conn), nil
+}
+
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		mode:    int32(DocumentMap),
+		pending: make(map[int32]chan *clientResult),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+/*
+设置回复中文档的解码方式,对之后读取的回复生效
+*/
+func (c *Client) SetDocumentMode(mode DocumentMode) {
+	atomic.StoreInt32(&c.mode, int32(mode))
+}
+
+func (c *Client) Close() error {
+	e := c.conn.Close()
+	<-c.done
+	return e
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		header, message, e := DecodeMessage(c.conn, DocumentMode(atomic.LoadInt32(&c.mode)))
+		if e != nil && header == nil {
+			c.fail(e)
+			return
+		}
+		c.lock.Lock()
+		ch, ok := c.pending[header.ResponseTo]
+		delete(c.pending, header.ResponseTo)
+		c.lock.Unlock()
+		if !ok {
+			logrus.Warnf("[client]drop reply to unknown request %d", header.ResponseTo)
+			continue
+		}
+		ch <- &clientResult{header: header, message: message, err: e}
+	}
+}
+
+func (c *Client) fail(e error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = e
+	for id, ch := range c.pending {
+		ch <- &clientResult{err: e}
+		delete(c.pending, id)
+	}
+}
+
+/*
+发送请求并等待回复,expectReply为false时(如OP_INSERT或moreToCome)只发送
+*/
+func (c *Client) RoundTrip(ctx context.Context, request Request, expectReply bool) (UnMarshaler, error) {
+	header := request.GetHeader()
+	header.RequestID = nextRequestID()
+	var ch chan *clientResult
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, ErrClientClosed
+	}
+	if expectReply {
+		ch = make(chan *clientResult, 1)
+		c.pending[header.RequestID] = ch
+	}
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	e := request.Write(c.conn)
+	c.writeLock.Unlock()
+	if e != nil || !expectReply {
+		c.forget(header.RequestID)
+		return nil, e
+	}
+	select {
+	case result := <-ch:
+		return result.message, result.err
+	case <-ctx.Done():
+		c.forget(header.RequestID)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) forget(requestID int32) {
+	c.lock.Lock()
+	delete(c.pending, requestID)
+	c.lock.Unlock()
+}
+
+/*
+发送OP_MSG,设置了moreToCome时没有回复,返回nil
+*/
+func (c *Client) SendMsg(ctx context.Context, msg *Msg) (*MsgReply, error) {
+	expectReply := !msg.FlatBits.Has(MoreToCome)
+	message, e := c.RoundTrip(ctx, msg, expectReply)
+	if e != nil || !expectReply {
+		return nil, e
+	}
+	reply, ok := message.(*MsgReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T for OP_MSG", message)
+	}
+	return reply, nil
+}
+
+func (c *Client) SendQuery(ctx context.Context, query *Query) (*Reply, error) {
+	return c.sendForReply(ctx, query)
+}
+
+func (c *Client) SendGetMore(ctx context.Context, getMore *GetMore) (*Reply, error) {
+	return c.sendForReply(ctx, getMore)
+}
+
+func (c *Client) sendForReply(ctx context.Context, request Request) (*Reply, error) {
+	message, e := c.RoundTrip(ctx, request, true)
+	if e != nil {
+		return nil, e
+	}
+	reply, ok := message.(*Reply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T for %v", message, request.GetHeader().OpCode)
+	}
+	return reply, nil
+}
+
+/*
+执行一个命令,cmd的第一个元素为命令名称;回复ok为0时返回CommandError
+*/
+func (c *Client) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.M, error) {
+	body := NewBodyMsgSection()
+	body.BodyD = append(append(bson.D{}, cmd...), bson.DocElem{Name: "$db", Value: db})
+	msg := &Msg{Sections: []MsgSection{body}}
+	reply, e := c.SendMsg(ctx, msg)
+	if e != nil {
+		return nil, e
+	}
+	raw := reply.GetBodyMsgSectionRaw()
+	result := bson.M{}
+	if e := raw.Unmarshal(&result); e != nil {
+		return nil, e
+	}
+	if !isOk(result["ok"]) {
+		return result, commandErrorFromReply(result)
+	}
+	return result, nil
+}
+
+func isOk(v interface{}) bool {
+	switch ok := v.(type) {
+	case float64:
+		return ok != 0
+	case int:
+		return ok != 0
+	case int64:
+		return ok != 0
+	case bool:
+		return ok
+	}
+	return false
+}
+
+func commandErrorFromReply(result bson.M) *CommandError {
+	e := &CommandError{}
+	e.Message, _ = result["errmsg"].(string)
+	e.CodeName, _ = result["codeName"].(string)
+	switch code := result["code"].(type) {
+	case int:
+		e.Code = int32(code)
+	case int64:
+		e.Code = int32(code)
+	case float64:
+		e.Code = int32(code)
+	}
+	if labels, ok := result["errorLabels"].([]interface{}); ok {
+		for _, v := range labels {
+			if label, ok := v.(string); ok {
+				e.ErrorLabels = append(e.ErrorLabels, label)
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,73 @@
+package mongo_protocol
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClient(server *Server) *Client {
+	client, conn := net.Pipe()
+	go server.handler(context.TODO(), conn)
+	return NewClient(client)
+}
+
+func TestClientRunCommand(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	router.Handle("echo", func(cmd *Command) (interface{}, error) {
+		return bson.M{"ok": 1, "value": cmd.Value(), "db": cmd.Database}, nil
+	})
+	server.AddHandler(OP_MSG, router)
+	server.AddHandler(OP_QUERY, router)
+	client := newTestClient(server)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, e := client.RunCommand(ctx, "test", bson.D{{Name: "echo", Value: i}})
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if result["value"] != i || result["db"] != "test" {
+				t.Errorf("unexpected result %v for %d", result, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, e := client.RunCommand(ctx, "test", bson.D{{Name: "nosuchcommand", Value: 1}})
+	if ce, ok := e.(*CommandError); !ok || ce.Code != CodeCommandNotFound {
+		t.Fatalf("expected CommandNotFound, got %v", e)
+	}
+
+	query := &Query{FullCollectionName: "admin.$cmd", NumberToReturn: -1, QueryD: bson.D{{Name: "isMaster", Value: 1}}}
+	reply, e := client.SendQuery(ctx, query)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply.Header.ResponseTo != query.Header.RequestID || reply.Documents[0].(bson.M)["ismaster"] != true {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	client, conn := net.Pipe()
+	c := NewClient(client)
+	_ = conn.Close()
+	_, e := c.RunCommand(context.Background(), "admin", bson.D{{Name: "ping", Value: 1}})
+	if e == nil {
+		t.Fatal("expected error on closed connection")
+	}
+	_ = c.Close()
+}
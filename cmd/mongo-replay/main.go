@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	mongo_protocol "github.com/tangxusc/mongo-protocol"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+/*
+回放录制的流量并与录制的回复比较:
+
+	mongo-replay -file traffic.cap -target 127.0.0.1:27017 -speed 2
+*/
+func main() {
+	file := flag.String("file", "", "capture file written by RecordHandler")
+	target := flag.String("target", "127.0.0.1:27017", "address of the server to replay against")
+	speed := flag.Float64("speed", 1, "replay speed, 1 is the original timing, 0 sends without waiting")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout waiting for each reply")
+	ignore := flag.String("ignore", strings.Join(mongo_protocol.DefaultReplayIgnoreFields, ","), "comma separated fields ignored when comparing replies")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, e := os.Open(*file)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(2)
+	}
+	defer f.Close()
+	reader, e := mongo_protocol.NewCaptureReader(f)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(2)
+	}
+	records, e := reader.ReadAll()
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	report := mongo_protocol.Replay(ctx, records, &mongo_protocol.ReplayOptions{
+		Dial: func() (net.Conn, error) {
+			return net.Dial(`tcp`, *target)
+		},
+		Speed:        *speed,
+		Timeout:      *timeout,
+		IgnoreFields: splitFields(*ignore),
+	})
+	_, _ = report.WriteTo(os.Stdout)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func splitFields(s string) []string {
+	fields := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			fields = append(fields, v)
+		}
+	}
+	return fields
+}
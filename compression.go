@@ -0,0 +1,344 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+/*
+struct OP_COMPRESSED {
+    struct MsgHeader {
+        int32  messageLength;
+        int32  requestID;
+        int32  responseTo;
+        int32  opCode = 2012;
+    };
+    int32  originalOpcode;
+    int32  uncompressedSize;
+    uint8  compressorId;
+    char[] compressedMessage;
+};
+*/
+
+type CompressorID uint8
+
+const (
+	CompressorNoop   CompressorID = 0
+	CompressorSnappy CompressorID = 1
+	CompressorZlib   CompressorID = 2
+	CompressorZstd   CompressorID = 3
+)
+
+type Compressor interface {
+	ID() CompressorID
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte, uncompressedSize int) ([]byte, error)
+}
+
+var compressors = map[CompressorID]Compressor{
+	CompressorNoop:   &noopCompressor{},
+	CompressorSnappy: &snappyCompressor{},
+	CompressorZlib:   &zlibCompressor{},
+	CompressorZstd:   &zstdCompressor{},
+}
+
+func GetCompressor(id CompressorID) (Compressor, bool) {
+	c, ok := compressors[id]
+	return c, ok
+}
+
+func GetCompressorByName(name string) (Compressor, bool) {
+	for _, c := range compressors {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+type Compressed struct {
+	// opCode of the wrapped message
+	OriginalOpcode OpCode
+	// size of the wrapped message, excluding the MsgHeader
+	UncompressedSize int32
+	// which compressor was used, see CompressorID
+	CompressorId CompressorID
+	// the wrapped message, excluding the MsgHeader
+	CompressedMessage []byte
+}
+
+func (c *Compressed) UnMarshal(r *Reader) error {
+	op, e := r.ReadInt32()
+	if e != nil {
+		return e
+	}
+	c.OriginalOpcode = OpCode(op)
+	size, e := r.ReadInt32()
+	if e != nil {
+		return e
+	}
+	c.UncompressedSize = size
+	id, e := r.ReadBytes(1)
+	if e != nil {
+		return e
+	}
+	c.CompressorId = CompressorID(id[0])
+	c.CompressedMessage, e = ioutil.ReadAll(r)
+	return e
+}
+
+func (c *Compressed) Decompress() ([]byte, error) {
+	compressor, ok := GetCompressor(c.CompressorId)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compressorId %d", c.CompressorId)
+	}
+	if c.UncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressedSize %d", c.UncompressedSize)
+	}
+	out, e := compressor.Decompress(c.CompressedMessage, int(c.UncompressedSize))
+	if e != nil {
+		return nil, e
+	}
+	if len(out) != int(c.UncompressedSize) {
+		return nil, fmt.Errorf("uncompressedSize mismatch: header %d, actual %d", c.UncompressedSize, len(out))
+	}
+	return out, nil
+}
+
+/*
+把OP_COMPRESSED消息还原为原始的header与body
+*/
+func decompressMessage(header *MsgHeader, body []byte) (*MsgHeader, []byte, Compressor, error) {
+	return decompressMessageLimit(header, body, DefaultMaxMessageSizeBytes, nil)
+}
+
+/*
+解压前检查还原后的消息长度,避免按不可信的uncompressedSize分配内存;
+解压失败时只要能读出originalOpcode,仍然返回原始消息的header,用于按原始opCode回复错误;
+allowed不为nil时拒绝其不允许的压缩器
+*/
+func decompressMessageLimit(header *MsgHeader, body []byte, maxSize int32, allowed func(Compressor) bool) (*MsgHeader, []byte, Compressor, error) {
+	c := &Compressed{}
+	if e := c.UnMarshal(&Reader{Reader: bytes.NewReader(body)}); e != nil {
+		return nil, nil, nil, e
+	}
+	original := &MsgHeader{
+		RequestID:  header.RequestID,
+		ResponseTo: header.ResponseTo,
+		OpCode:     c.OriginalOpcode,
+	}
+	compressor, ok := GetCompressor(c.CompressorId)
+	if !ok {
+		return original, nil, nil, fmt.Errorf("unsupported compressorId %d", c.CompressorId)
+	}
+	if allowed != nil && !allowed(compressor) {
+		return original, nil, nil, NewCommandError(CodeProtocolError, "compressor %s was not negotiated", compressor.Name())
+	}
+	if size := int64(c.UncompressedSize) + 4*4; size > int64(maxSize) {
+		return original, nil, nil, &SizeError{Kind: "message", Size: size, Min: 4 * 4, Max: int64(maxSize)}
+	}
+	out, e := c.Decompress()
+	if e != nil {
+		return original, nil, nil, e
+	}
+	original.MessageLength = int32(4*4 + len(out))
+	return original, out, compressor, nil
+}
+
+/*
+OP_COMPRESSED帧超过长度限制时body不会被读取,这里只读出originalOpcode,
+返回以原始opCode替换后的header;无法读取时返回原header
+*/
+func readOriginalHeader(r io.Reader, header *MsgHeader) *MsgHeader {
+	if header.OpCode != OP_COMPRESSED || header.MessageLength < 4*4+4 {
+		return header
+	}
+	var opCode int32
+	if e := binary.Read(r, binary.LittleEndian, &opCode); e != nil {
+		return header
+	}
+	original := *header
+	original.OpCode = OpCode(opCode)
+	return &original
+}
+
+/*
+把一个完整的消息帧(含header)压缩为OP_COMPRESSED帧
+*/
+func compressFrame(frame []byte, compressor Compressor) ([]byte, error) {
+	header := &MsgHeader{}
+	if e := binary.Read(bytes.NewReader(frame), binary.LittleEndian, header); e != nil {
+		return nil, e
+	}
+	body := frame[4*4:]
+	out, e := compressor.Compress(body)
+	if e != nil {
+		return nil, e
+	}
+	buffer := &bytes.Buffer{}
+	compressedHeader := &MsgHeader{
+		MessageLength: int32(4*4 + 4 + 4 + 1 + len(out)),
+		RequestID:     header.RequestID,
+		ResponseTo:    header.ResponseTo,
+		OpCode:        OP_COMPRESSED,
+	}
+	data := []interface{}{compressedHeader, int32(header.OpCode), int32(len(body)), uint8(compressor.ID())}
+	for _, v := range data {
+		if e := binary.Write(buffer, binary.LittleEndian, v); e != nil {
+			return nil, e
+		}
+	}
+	buffer.Write(out)
+	return buffer.Bytes(), nil
+}
+
+type noopCompressor struct {
+}
+
+func (n *noopCompressor) ID() CompressorID {
+	return CompressorNoop
+}
+
+func (n *noopCompressor) Name() string {
+	return "noop"
+}
+
+func (n *noopCompressor) Compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (n *noopCompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	return src, nil
+}
+
+type snappyCompressor struct {
+}
+
+func (s *snappyCompressor) ID() CompressorID {
+	return CompressorSnappy
+}
+
+func (s *snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (s *snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (s *snappyCompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	//snappy.Decode按压缩数据中声明的长度分配内存,需要先与uncompressedSize比较
+	n, e := snappy.DecodedLen(src)
+	if e != nil {
+		return nil, e
+	}
+	if n != uncompressedSize {
+		return nil, fmt.Errorf("uncompressedSize mismatch: header %d, actual %d", uncompressedSize, n)
+	}
+	return snappy.Decode(make([]byte, n), src)
+}
+
+type zlibCompressor struct {
+}
+
+func (z *zlibCompressor) ID() CompressorID {
+	return CompressorZlib
+}
+
+func (z *zlibCompressor) Name() string {
+	return "zlib"
+}
+
+func (z *zlibCompressor) Compress(src []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	w := zlib.NewWriter(buffer)
+	if _, e := w.Write(src); e != nil {
+		return nil, e
+	}
+	if e := w.Close(); e != nil {
+		return nil, e
+	}
+	return buffer.Bytes(), nil
+}
+
+func (z *zlibCompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	r, e := zlib.NewReader(bytes.NewReader(src))
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	return readUncompressed(r, uncompressedSize)
+}
+
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	e       error
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		z.encoder, z.e = zstd.NewWriter(nil)
+	})
+	return z.e
+}
+
+func (z *zstdCompressor) ID() CompressorID {
+	return CompressorZstd
+}
+
+func (z *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (z *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if e := z.init(); e != nil {
+		return nil, e
+	}
+	return z.encoder.EncodeAll(src, nil), nil
+}
+
+/*
+流式解码时窗口的最大值,至少允许默认8MB窗口的流式编码器
+*/
+const zstdMinDecoderMemory = 8 << 20
+
+/*
+DecodeAll没有输出长度的限制,这里使用流式解码,最多读取uncompressedSize+1字节,
+并按uncompressedSize限制帧声明的窗口大小
+*/
+func (z *zstdCompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	maxMemory := uint64(zstdMinDecoderMemory)
+	if uint64(uncompressedSize) > maxMemory {
+		maxMemory = uint64(uncompressedSize)
+	}
+	decoder, e := zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxMemory))
+	if e != nil {
+		return nil, e
+	}
+	defer decoder.Close()
+	return readUncompressed(decoder, uncompressedSize)
+}
+
+/*
+从解压流中读取恰好uncompressedSize字节,数据更多或更少时返回错误
+*/
+func readUncompressed(r io.Reader, uncompressedSize int) ([]byte, error) {
+	out := make([]byte, uncompressedSize+1)
+	n, e := io.ReadFull(io.LimitReader(r, int64(uncompressedSize)+1), out)
+	if e != nil && e != io.ErrUnexpectedEOF && e != io.EOF {
+		return nil, e
+	}
+	if n != uncompressedSize {
+		return nil, fmt.Errorf("uncompressedSize mismatch: header %d, actual at least %d", uncompressedSize, n)
+	}
+	return out[:n], nil
+}
@@ -0,0 +1,176 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestCompressFrame(t *testing.T) {
+	for _, name := range []string{"noop", "snappy", "zlib", "zstd"} {
+		compressor, ok := GetCompressorByName(name)
+		if !ok {
+			t.Fatalf("compressor %s not found", name)
+		}
+		reply := NewMsgReply(7)
+		section := NewBodyMsgSection()
+		section.Body = bson.M{"ok": 1, "name": name}
+		reply.Sections = append(reply.Sections, section)
+		buffer := &bytes.Buffer{}
+		if e := reply.Write(buffer); e != nil {
+			t.Fatal(e)
+		}
+		frame, e := compressFrame(buffer.Bytes(), compressor)
+		if e != nil {
+			t.Fatal(e)
+		}
+		header, body, e := readMessage(bytes.NewReader(frame))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if header.OpCode != OP_COMPRESSED {
+			t.Fatalf("%s: expected OP_COMPRESSED, got %v", name, header.OpCode)
+		}
+		header, body, c, e := decompressMessage(header, body)
+		if e != nil {
+			t.Fatalf("%s: %v", name, e)
+		}
+		if c.ID() != compressor.ID() || header.OpCode != OP_MSG || header.ResponseTo != 7 {
+			t.Fatalf("%s: unexpected header %v", name, *header)
+		}
+		if !bytes.Equal(body, buffer.Bytes()[4*4:]) {
+			t.Fatalf("%s: body mismatch", name)
+		}
+	}
+}
+
+/*
+解压时不能按压缩数据中声明的长度分配内存
+*/
+func TestDecompressLimits(t *testing.T) {
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	//snappy头部声明4GB
+	bomb := make([]byte, binary.MaxVarintLen64)
+	bomb = append(bomb[:binary.PutUvarint(bomb, 1<<32-1)], 0)
+	var e error
+	if n := allocated(func() { _, e = compressors[CompressorSnappy].Decompress(bomb, 100) }); e == nil || n > 1<<20 {
+		t.Fatalf("snappy: expected error without allocation, got %v after %d bytes", e, n)
+	}
+
+	encoder, _ := zstd.NewWriter(nil)
+	zeros := encoder.EncodeAll(make([]byte, 64<<20), nil)
+	if n := allocated(func() { _, e = compressors[CompressorZstd].Decompress(zeros, 100) }); e == nil || n > 16<<20 {
+		t.Fatalf("zstd: expected error without allocation, got %v after %d bytes", e, n)
+	}
+	//解压后的长度必须与uncompressedSize一致
+	for _, id := range []CompressorID{CompressorSnappy, CompressorZlib, CompressorZstd} {
+		src, _ := compressors[id].Compress([]byte("hello"))
+		for _, size := range []int{4, 6} {
+			if _, e := compressors[id].Decompress(src, size); e == nil {
+				t.Fatalf("%s: expected size mismatch for %d", compressors[id].Name(), size)
+			}
+		}
+	}
+	//流式编码器声明默认8MB窗口,仍然可以解压
+	buffer := &bytes.Buffer{}
+	w, _ := zstd.NewWriter(buffer)
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+	if out, e := compressors[CompressorZstd].Decompress(buffer.Bytes(), 5); e != nil || string(out) != "hello" {
+		t.Fatalf("zstd: unexpected %q %v", out, e)
+	}
+	if _, e := compressors[CompressorZstd].Decompress(buffer.Bytes(), 4); e == nil {
+		t.Fatal("zstd: expected size mismatch")
+	}
+}
+
+type echoHandler struct {
+}
+
+func (h *echoHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	msg := &Msg{}
+	if e := msg.UnMarshal(r); e != nil {
+		return e
+	}
+	reply := NewMsgReply(header.RequestID)
+	section := NewBodyMsgSection()
+	section.Body = msg.GetBodyMsgSection()
+	reply.Sections = append(reply.Sections, section)
+	return reply.Write(conn)
+}
+
+func sendCompressedTestMsg(t *testing.T, w io.Writer, requestID int32, compressor Compressor, body interface{}) {
+	buffer := &bytes.Buffer{}
+	sendTestMsg(t, buffer, requestID, 0, body)
+	frame, e := compressFrame(buffer.Bytes(), compressor)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := w.Write(frame); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestServerCompressedRoundTrip(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	router.Handle("echo", func(cmd *Command) (interface{}, error) {
+		return bson.M{"echo": cmd.Value(), "ok": 1.0}, nil
+	})
+	server.AddHandler(OP_MSG, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	//握手之前没有协商压缩器
+	sendCompressedTestMsg(t, client, 41, compressors[CompressorZlib], bson.D{{Name: "echo", Value: 1}, {Name: "$db", Value: "admin"}})
+	header, msg := readTestMsg(t, client)
+	if header.ResponseTo != 41 || msg.GetBodyMsgSection()["code"] != int(CodeProtocolError) {
+		t.Fatalf("unexpected reply %v %v", *header, msg.GetBodyMsgSection())
+	}
+	sendTestMsg(t, client, 1, 0, bson.D{{Name: "hello", Value: 1}, {Name: "compression", Value: []string{"zlib"}}, {Name: "$db", Value: "admin"}})
+	readTestMsg(t, client)
+
+	sendCompressedTestMsg(t, client, 42, compressors[CompressorZlib], bson.D{{Name: "echo", Value: "ping"}, {Name: "$db", Value: "admin"}})
+	header, body, e := readMessage(client)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if header.OpCode != OP_COMPRESSED {
+		t.Fatalf("expected compressed reply, got %v", header.OpCode)
+	}
+	header, body, c, e := decompressMessage(header, body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if c.ID() != CompressorZlib || header.ResponseTo != 42 {
+		t.Fatalf("unexpected reply header %v", *header)
+	}
+	reply := &Msg{}
+	if e := reply.UnMarshal(&Reader{Reader: bytes.NewReader(body)}); e != nil {
+		t.Fatal(e)
+	}
+	if reply.GetBodyMsgSection()["echo"] != "ping" {
+		t.Fatalf("unexpected reply body %v", reply.GetBodyMsgSection())
+	}
+
+	//snappy已在服务端启用,但该连接只协商了zlib
+	sendCompressedTestMsg(t, client, 43, compressors[CompressorSnappy], bson.D{{Name: "echo", Value: 1}, {Name: "$db", Value: "admin"}})
+	header, msg = readTestMsg(t, client)
+	if header.ResponseTo != 43 || msg.GetBodyMsgSection()["code"] != int(CodeProtocolError) {
+		t.Fatalf("unexpected reply %v %v", *header, msg.GetBodyMsgSection())
+	}
+}
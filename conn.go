@@ -0,0 +1,385 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var lastConnectionID int64
+
+/*
+客户端握手时在hello/isMaster中发送的client文档
+*/
+type ClientMetadata struct {
+	ApplicationName string
+	DriverName      string
+	DriverVersion   string
+	OSType          string
+	OSName          string
+	OSArchitecture  string
+	OSVersion       string
+	Platform        string
+	// 原始的client文档
+	Raw bson.M
+}
+
+/*
+从client文档解析,缺少的字段为空字符串
+*/
+func NewClientMetadata(doc bson.M) *ClientMetadata {
+	field := func(parent string, name string) string {
+		if sub, ok := doc[parent].(bson.M); ok {
+			v, _ := sub[name].(string)
+			return v
+		}
+		return ""
+	}
+	platform, _ := doc["platform"].(string)
+	return &ClientMetadata{
+		ApplicationName: field("application", "name"),
+		DriverName:      field("driver", "name"),
+		DriverVersion:   field("driver", "version"),
+		OSType:          field("os", "type"),
+		OSName:          field("os", "name"),
+		OSArchitecture:  field("os", "architecture"),
+		OSVersion:       field("os", "version"),
+		Platform:        platform,
+		Raw:             doc,
+	}
+}
+
+/*
+已认证的用户
+*/
+type AuthenticatedUser struct {
+	User string
+	DB   string
+}
+
+/*
+最近一次旧版写操作(OP_INSERT/OP_UPDATE/OP_DELETE)的结果,由getLastError返回
+*/
+type LastError struct {
+	// 写入、更新或删除的文档数
+	N int
+	// 没有错误时为nil
+	Err *CommandError
+}
+
+/*
+一个客户端连接,可以在多个goroutine中同时使用(如exhaust cursor或后台任务)
+*/
+type ConnContext struct {
+	net.Conn
+	id       int64
+	accepted time.Time
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// 保护m以及以下的元数据
+	lock sync.RWMutex
+	m    map[string]interface{}
+	// 握手时协商的压缩器
+	compression []string
+	client      *ClientMetadata
+	user        *AuthenticatedUser
+	op          *Operation
+	lastError   *LastError
+	closers     []func()
+	closeOnce   sync.Once
+
+	// 以下字段由writeLock保护,回复的写出需要串行
+	writeLock sync.Mutex
+	// 当前请求使用的压缩器,回复将使用同一个压缩器;
+	// 其他goroutine此时写出的帧也会使用它,它总是握手时协商过的压缩器
+	compressor Compressor
+	pending    bytes.Buffer
+	// 当前请求设置了moreToCome,不需要回复:只丢弃responseTo为该请求的帧
+	moreToCome   bool
+	moreToComeID int32
+	// 写出的每个完整回复帧(压缩前)都会传给taps,用于流量录制
+	taps []func(frame []byte)
+	// 每次写出的超时,超时后连接会被关闭
+	writeTimeout  time.Duration
+	writeTimedOut bool
+}
+
+func NewConnContext(conn net.Conn) *ConnContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConnContext{
+		Conn:     conn,
+		m:        make(map[string]interface{}),
+		id:       atomic.AddInt64(&lastConnectionID, 1),
+		accepted: time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+/*
+注册连接关闭时执行的函数,如关闭代理的上游连接
+*/
+func (c *ConnContext) OnClose(f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closers = append(c.closers, f)
+}
+
+func (c *ConnContext) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.lock.RLock()
+		closers := c.closers
+		c.lock.RUnlock()
+		for _, f := range closers {
+			f()
+		}
+	})
+	return c.Conn.Close()
+}
+
+/*
+连接关闭时被取消,可用于结束该连接上启动的goroutine
+*/
+func (c *ConnContext) Context() context.Context {
+	return c.ctx
+}
+
+/*
+回复可能被分多次写入,此处按帧(messageLength)组装完整后再压缩写出;
+多个goroutine同时写同一连接时,每次Write需要是完整的帧,否则帧之间会交错
+*/
+func (c *ConnContext) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.compressor == nil && len(c.taps) == 0 && c.pending.Len() == 0 && !c.moreToCome {
+		return c.write(b)
+	}
+	c.pending.Write(b)
+	for c.pending.Len() >= 4 {
+		size := int(binary.LittleEndian.Uint32(c.pending.Bytes()))
+		if size < 4*4 {
+			_, e := c.write(c.pending.Next(c.pending.Len()))
+			if e != nil {
+				return 0, e
+			}
+			break
+		}
+		if c.pending.Len() < size {
+			break
+		}
+		frame := c.pending.Next(size)
+		if c.moreToCome && int32(binary.LittleEndian.Uint32(frame[8:])) == c.moreToComeID {
+			continue
+		}
+		for _, tap := range c.taps {
+			tap(frame)
+		}
+		if c.compressor != nil {
+			out, e := compressFrame(frame, c.compressor)
+			if e != nil {
+				return 0, e
+			}
+			frame = out
+		}
+		if _, e := c.write(frame); e != nil {
+			return 0, e
+		}
+	}
+	return len(b), nil
+}
+
+func (c *ConnContext) write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	n, e := c.Conn.Write(b)
+	if e != nil && isTimeout(e) {
+		c.writeTimedOut = true
+	}
+	return n, e
+}
+
+/*
+设置当前请求的压缩器与moreToCome,由Server在处理每个请求前后调用
+*/
+func (c *ConnContext) setRequest(header *MsgHeader, compressor Compressor, moreToCome bool) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.compressor = compressor
+	c.moreToCome = moreToCome
+	c.moreToComeID = 0
+	if header != nil {
+		c.moreToComeID = header.RequestID
+	}
+}
+
+func (c *ConnContext) addTap(tap func(frame []byte)) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.taps = append(c.taps, tap)
+}
+
+func (c *ConnContext) timedOut() bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.writeTimedOut
+}
+
+/*
+当前请求使用的压缩器,请求未压缩时返回nil
+*/
+func (c *ConnContext) Compressor() Compressor {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.compressor
+}
+
+func (c *ConnContext) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m[key] = value
+}
+
+func (c *ConnContext) Get(key string) (value interface{}, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	value, ok = c.m[key]
+	return
+}
+
+func (c *ConnContext) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.m, key)
+}
+
+/*
+key不存在时设置为value并返回true,用于每个连接只需要初始化一次的数据
+*/
+func (c *ConnContext) SetIfAbsent(key string, value interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.m[key]; ok {
+		return false
+	}
+	c.m[key] = value
+	return true
+}
+
+/*
+连接id,按连接建立的顺序单调递增
+*/
+func (c *ConnContext) ID() int64 {
+	return c.id
+}
+
+/*
+连接建立的时间
+*/
+func (c *ConnContext) AcceptedAt() time.Time {
+	return c.accepted
+}
+
+/*
+TLS连接的状态,非TLS连接返回nil
+*/
+func (c *ConnContext) TLSState() *tls.ConnectionState {
+	if conn, ok := c.Conn.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+/*
+客户端证书链,第一个为客户端证书;非TLS连接或客户端没有提供证书时返回nil
+*/
+func (c *ConnContext) PeerCertificates() []*x509.Certificate {
+	if state := c.TLSState(); state != nil {
+		return state.PeerCertificates
+	}
+	return nil
+}
+
+func (c *ConnContext) Compression() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.compression
+}
+
+func (c *ConnContext) SetCompression(names []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.compression = names
+}
+
+/*
+握手时客户端发送的元数据,没有发送时返回nil
+*/
+func (c *ConnContext) ClientMetadata() *ClientMetadata {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.client
+}
+
+func (c *ConnContext) SetClientMetadata(client *ClientMetadata) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.client = client
+}
+
+/*
+已认证的用户,未认证时返回nil
+*/
+func (c *ConnContext) User() *AuthenticatedUser {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.user
+}
+
+/*
+认证成功后设置,传入nil表示登出
+*/
+func (c *ConnContext) SetUser(user *AuthenticatedUser) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.user = user
+}
+
+/*
+最近一次旧版写操作的结果,没有执行过时返回nil
+*/
+func (c *ConnContext) LastError() *LastError {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lastError
+}
+
+func (c *ConnContext) SetLastError(lastError *LastError) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastError = lastError
+}
+
+/*
+连接上正在处理的请求,空闲时返回nil
+*/
+func (c *ConnContext) Operation() *Operation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.op
+}
+
+func (c *ConnContext) setOperation(op *Operation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.op = op
+}
@@ -0,0 +1,166 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnContextConcurrent(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	c := NewConnContext(conn)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i%5)
+			for j := 0; j < 100; j++ {
+				c.Set(key, j)
+				c.Get(key)
+				c.SetIfAbsent("once", i)
+				c.SetCompression([]string{"zlib"})
+				c.Compression()
+				c.SetUser(&AuthenticatedUser{User: "u", DB: "admin"})
+				c.User()
+				c.Delete(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if v, ok := c.Get("once"); !ok || v == nil {
+		t.Fatal("expected once to be set")
+	}
+
+	closed := make(chan struct{})
+	c.OnClose(func() {
+		close(closed)
+	})
+	if c.AcceptedAt().IsZero() || time.Since(c.AcceptedAt()) > time.Minute {
+		t.Fatalf("unexpected accepted time %v", c.AcceptedAt())
+	}
+	c.Close()
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled on close")
+	}
+	<-closed
+}
+
+func TestConnContextMetadata(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	router.Handle("login", func(cmd *Command) (interface{}, error) {
+		cmd.Conn.SetUser(&AuthenticatedUser{User: cmd.Value().(string), DB: cmd.Database})
+		return bson.M{"ok": 1.0}, nil
+	})
+	router.Handle("whoami", func(cmd *Command) (interface{}, error) {
+		client := cmd.Conn.ClientMetadata()
+		return bson.M{"app": client.ApplicationName, "driver": client.DriverName + " " + client.DriverVersion, "os": client.OSType, "ok": 1.0}, nil
+	})
+	server.AddHandler(OP_MSG, router)
+	conn := newHandshakeTestConn(server)
+	defer conn.Close()
+
+	sendTestMsg(t, conn, 1, 0, bson.D{
+		{Name: "hello", Value: 1},
+		{Name: "client", Value: bson.D{
+			{Name: "application", Value: bson.D{{Name: "name", Value: "billing"}}},
+			{Name: "driver", Value: bson.D{{Name: "name", Value: "mongo-go-driver"}, {Name: "version", Value: "1.4.0"}}},
+			{Name: "os", Value: bson.D{{Name: "type", Value: "linux"}}},
+		}},
+		{Name: "$db", Value: "admin"},
+	})
+	readTestMsg(t, conn)
+	// 第二次握手的client会被忽略
+	sendTestMsg(t, conn, 2, 0, bson.D{
+		{Name: "hello", Value: 1},
+		{Name: "client", Value: bson.D{{Name: "application", Value: bson.D{{Name: "name", Value: "other"}}}}},
+		{Name: "$db", Value: "admin"},
+	})
+	readTestMsg(t, conn)
+
+	sendTestMsg(t, conn, 3, 0, bson.D{{Name: "whoami", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg := readTestMsg(t, conn)
+	if body := msg.GetBodyMsgSection(); body["app"] != "billing" || body["driver"] != "mongo-go-driver 1.4.0" || body["os"] != "linux" {
+		t.Fatalf("unexpected metadata %v", body)
+	}
+
+	sendTestMsg(t, conn, 4, 0, bson.D{{Name: "login", Value: "alice"}, {Name: "$db", Value: "test"}})
+	readTestMsg(t, conn)
+	sendTestMsg(t, conn, 5, 0, bson.D{{Name: "connectionStatus", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, conn)
+	users := msg.GetBodyMsgSection()["authInfo"].(bson.M)["authenticatedUsers"].([]interface{})
+	if len(users) != 1 || users[0].(bson.M)["user"] != "alice" || users[0].(bson.M)["db"] != "test" {
+		t.Fatalf("unexpected users %v", users)
+	}
+}
+
+/*
+多个goroutine同时写回复时,每个回复需要是一个完整的帧
+*/
+func TestConnContextConcurrentReplies(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	c := NewConnContext(conn)
+	defer c.Close()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	const writers, replies = 8, 50
+	go func() {
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < replies; j++ {
+					reply := NewReply(int32(i))
+					reply.Documents = append(reply.Documents, bson.D{{Name: "writer", Value: i}, {Name: "n", Value: j}})
+					if e := reply.Write(c); e != nil {
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	}()
+	for n := 0; n < writers*replies; n++ {
+		_, reply := readTestReply(t, client)
+		if reply["writer"] == nil || reply["n"] == nil {
+			t.Fatalf("unexpected reply %v", reply)
+		}
+	}
+}
+
+/*
+moreToCome只丢弃当前请求的回复,其他goroutine写出的帧不受影响
+*/
+func TestConnContextMoreToCome(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	c := NewConnContext(conn)
+	defer c.Close()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.setRequest(&MsgHeader{RequestID: 5}, nil, true)
+	go func() {
+		for _, responseTo := range []int32{5, 9} {
+			buffer := &bytes.Buffer{}
+			reply := NewReply(responseTo)
+			reply.Documents = append(reply.Documents, bson.M{"ok": 1.0})
+			_ = reply.Write(buffer)
+			//分两次写入同一个帧
+			_, _ = c.Write(buffer.Next(10))
+			_, _ = c.Write(buffer.Bytes())
+		}
+	}()
+	header, _ := readTestReply(t, client)
+	if header.ResponseTo != 9 {
+		t.Fatalf("expected only the reply to 9, got responseTo %d", header.ResponseTo)
+	}
+}
@@ -0,0 +1,136 @@
+package mongo_protocol
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+MongoDB风格的命令错误,OP_MSG回复为 {ok:0, errmsg, code, codeName, errorLabels},
+OP_QUERY回复为 {$err, code} 并设置QueryFailure
+*/
+type CommandError struct {
+	Code        int32
+	CodeName    string
+	Message     string
+	ErrorLabels []string
+}
+
+const (
+	CodeInternalError             int32 = 1
+	CodeBadValue                  int32 = 2
+	CodeUnauthorized              int32 = 13
+	CodeTypeMismatch              int32 = 14
+	CodeCursorNotFound            int32 = 43
+	CodeCommandNotFound           int32 = 59
+	CodeNamespaceNotFound         int32 = 26
+	CodeInterrupted               int32 = 11601
+	CodeOperationFailed           int32 = 96
+	CodeInvalidBSON               int32 = 22
+	CodeProtocolError             int32 = 17
+	CodeCommandNotSupported       int32 = 115
+	CodeDocumentValidationFailure int32 = 121
+	CodeDuplicateKey              int32 = 11000
+	CodeBSONObjectTooLarge        int32 = 10334
+	CodeMaxTimeMSExpired          int32 = 50
+	CodeIllegalOperation          int32 = 20
+	CodeNotWritablePrimary        int32 = 10107
+	CodeInvalidNamespace          int32 = 73
+	CodeIndexNotFound             int32 = 27
+	CodeUnsupportedFormat         int32 = 12
+)
+
+var codeNames = map[int32]string{
+	CodeInternalError:             "InternalError",
+	CodeBadValue:                  "BadValue",
+	CodeUnauthorized:              "Unauthorized",
+	CodeTypeMismatch:              "TypeMismatch",
+	CodeCursorNotFound:            "CursorNotFound",
+	CodeCommandNotFound:           "CommandNotFound",
+	CodeNamespaceNotFound:         "NamespaceNotFound",
+	CodeInterrupted:               "Interrupted",
+	CodeOperationFailed:           "OperationFailed",
+	CodeInvalidBSON:               "InvalidBSON",
+	CodeProtocolError:             "ProtocolError",
+	CodeCommandNotSupported:       "CommandNotSupported",
+	CodeDocumentValidationFailure: "DocumentValidationFailure",
+	CodeDuplicateKey:              "DuplicateKey",
+	CodeBSONObjectTooLarge:        "BSONObjectTooLarge",
+	CodeMaxTimeMSExpired:          "MaxTimeMSExpired",
+	CodeIllegalOperation:          "IllegalOperation",
+	CodeNotWritablePrimary:        "NotWritablePrimary",
+	CodeInvalidNamespace:          "InvalidNamespace",
+	CodeIndexNotFound:             "IndexNotFound",
+	CodeUnsupportedFormat:         "UnsupportedFormat",
+}
+
+/*
+codeName由code推导,未知的code需要自行设置CodeName
+*/
+func NewCommandError(code int32, format string, args ...interface{}) *CommandError {
+	return &CommandError{
+		Code:     code,
+		CodeName: codeNames[code],
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (c *CommandError) Error() string {
+	if c.CodeName == "" {
+		return c.Message
+	}
+	return fmt.Sprintf("(%s) %s", c.CodeName, c.Message)
+}
+
+func (c *CommandError) AddLabel(label string) *CommandError {
+	c.ErrorLabels = append(c.ErrorLabels, label)
+	return c
+}
+
+/*
+OP_MSG及$cmd命令的错误回复文档
+*/
+func (c *CommandError) Document() bson.M {
+	doc := bson.M{
+		"ok":     0.0,
+		"errmsg": c.Message,
+		"code":   c.Code,
+	}
+	if c.CodeName != "" {
+		doc["codeName"] = c.CodeName
+	}
+	if len(c.ErrorLabels) > 0 {
+		doc["errorLabels"] = c.ErrorLabels
+	}
+	return doc
+}
+
+/*
+旧版OP_QUERY查询失败时的回复文档
+*/
+func (c *CommandError) QueryFailureDocument() bson.M {
+	return bson.M{
+		"$err": c.Message,
+		"code": c.Code,
+	}
+}
+
+/*
+将任意错误(或recover得到的值)转换为CommandError
+*/
+func ToCommandError(e interface{}) *CommandError {
+	switch v := e.(type) {
+	case *CommandError:
+		return v
+	case *ChecksumError:
+		return NewCommandError(CodeInvalidBSON, "%s", v.Error())
+	case *SizeError:
+		if v.Kind == "document" && v.Size > v.Max {
+			return NewCommandError(CodeBSONObjectTooLarge, "%s", v.Error())
+		}
+		return NewCommandError(CodeProtocolError, "%s", v.Error())
+	case error:
+		return NewCommandError(CodeInternalError, "%s", v.Error())
+	}
+	return NewCommandError(CodeInternalError, "%v", e)
+}
@@ -0,0 +1,113 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"testing"
+)
+
+type failingHandler struct {
+}
+
+func (f *failingHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	return errors.New("boom")
+}
+
+func TestErrorReplyMatchesOpCode(t *testing.T) {
+	server := NewServer(`0`)
+	server.SetDefaultHandler(&failingHandler{})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestMsg(t, client, 1, 0, bson.M{"ping": 1})
+	header, msg := readTestMsg(t, client)
+	body := msg.GetBodyMsgSection()
+	if header.OpCode != OP_MSG || header.ResponseTo != 1 || body["ok"] != 0.0 || body["errmsg"] != "boom" || body["codeName"] != "InternalError" {
+		t.Fatalf("unexpected error reply %v %v", *header, body)
+	}
+
+	sendTestQuery(t, client, 2, "test.users", bson.M{})
+	header, data, e := readMessage(client)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reply := &Reply{}
+	if e := reply.UnMarshal(&Reader{Reader: bytes.NewReader(data), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	if !reply.ResponseFlags.Has(QueryFailure) || reply.ResponseFlags.Has(CursorNotFound) {
+		t.Fatalf("unexpected response flags %b", reply.ResponseFlags)
+	}
+	if reply.Header.ResponseTo != 2 || reply.Documents[0].(bson.M)["$err"] != "boom" {
+		t.Fatalf("unexpected error reply %v", reply.Documents)
+	}
+}
+
+func TestCommandErrorReply(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	router.Handle("insert", func(cmd *Command) (interface{}, error) {
+		return nil, NewCommandError(CodeDuplicateKey, "duplicate key").AddLabel("RetryableWriteError")
+	})
+	server.AddHandler(OP_MSG, router)
+	server.AddHandler(OP_QUERY, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestMsg(t, client, 1, 0, bson.D{{Name: "insert", Value: "users"}, {Name: "$db", Value: "test"}})
+	_, msg := readTestMsg(t, client)
+	body := msg.GetBodyMsgSection()
+	labels, _ := body["errorLabels"].([]interface{})
+	if body["ok"] != 0.0 || body["code"] != 11000 || body["codeName"] != "DuplicateKey" || len(labels) != 1 {
+		t.Fatalf("unexpected error reply %v", body)
+	}
+
+	sendTestQuery(t, client, 2, "admin.$cmd", bson.M{"nosuchcommand": 1})
+	_, reply := readTestReply(t, client)
+	if reply["ok"] != 0.0 || reply["code"] != 59 || reply["codeName"] != "CommandNotFound" {
+		t.Fatalf("unexpected error reply %v", reply)
+	}
+}
+
+func TestCompressedErrorReply(t *testing.T) {
+	server := NewServer(`0`)
+	server.MaxMessageSizeBytes = 1024
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	//解压失败,错误回复使用originalOpcode
+	payload := []byte("not zlib")
+	frame := &bytes.Buffer{}
+	header := &MsgHeader{MessageLength: int32(4*4 + 4 + 4 + 1 + len(payload)), RequestID: 3, OpCode: OP_COMPRESSED}
+	for _, v := range []interface{}{header, int32(OP_MSG), int32(64), uint8(CompressorZlib), payload} {
+		_ = binary.Write(frame, binary.LittleEndian, v)
+	}
+	if _, e := client.Write(frame.Bytes()); e != nil {
+		t.Fatal(e)
+	}
+	replyHeader, msg := readTestMsg(t, client)
+	if replyHeader.OpCode != OP_MSG || replyHeader.ResponseTo != 3 || msg.GetBodyMsgSection()["ok"] != 0.0 {
+		t.Fatalf("unexpected error reply %v %v", *replyHeader, msg.GetBodyMsgSection())
+	}
+
+	//帧超过长度限制,只读取originalOpcode,回复后关闭连接
+	header = &MsgHeader{MessageLength: 4096, RequestID: 4, OpCode: OP_COMPRESSED}
+	if e := binary.Write(client, binary.LittleEndian, header); e != nil {
+		t.Fatal(e)
+	}
+	if e := binary.Write(client, binary.LittleEndian, int32(OP_MSG)); e != nil {
+		t.Fatal(e)
+	}
+	replyHeader, msg = readTestMsg(t, client)
+	if replyHeader.OpCode != OP_MSG || replyHeader.ResponseTo != 4 || msg.GetBodyMsgSection()["code"] != int(CodeProtocolError) {
+		t.Fatalf("unexpected error reply %v %v", *replyHeader, msg.GetBodyMsgSection())
+	}
+	expectClosed(t, client)
+}
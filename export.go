@@ -0,0 +1,274 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"sort"
+	"time"
+)
+
+var opCodeNames = map[OpCode]string{
+	OP_REPLY:        "OP_REPLY",
+	OP_UPDATE:       "OP_UPDATE",
+	OP_INSERT:       "OP_INSERT",
+	RESERVED:        "RESERVED",
+	OP_QUERY:        "OP_QUERY",
+	OP_GET_MORE:     "OP_GET_MORE",
+	OP_DELETE:       "OP_DELETE",
+	OP_KILL_CURSORS: "OP_KILL_CURSORS",
+	OP_COMPRESSED:   "OP_COMPRESSED",
+	OP_MSG:          "OP_MSG",
+}
+
+func opCodeName(code OpCode) interface{} {
+	if name, ok := opCodeNames[code]; ok {
+		return name
+	}
+	return int32(code)
+}
+
+/*
+将录制文件导出为JSON lines,每条记录一行;
+文档使用MongoDB Extended JSON,保留ObjectId,Int64,Date,Binary等类型以及key的顺序
+*/
+func ExportJSONLines(r *CaptureReader, w io.Writer) error {
+	for {
+		record, e := r.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		line, e := RecordJSON(record)
+		if e != nil {
+			return e
+		}
+		if _, e := w.Write(append(line, '\n')); e != nil {
+			return e
+		}
+	}
+}
+
+/*
+单条记录的JSON,消息无法解码时输出error与原始帧
+*/
+func RecordJSON(record *CaptureRecord) ([]byte, error) {
+	doc := bson.D{
+		{Name: "time", Value: record.Time.UTC().Format(time.RFC3339Nano)},
+		{Name: "connectionId", Value: record.ConnectionID},
+		{Name: "direction", Value: record.Direction.String()},
+		{Name: "opCode", Value: opCodeName(record.Header.OpCode)},
+		{Name: "requestId", Value: record.Header.RequestID},
+		{Name: "responseTo", Value: record.Header.ResponseTo},
+	}
+	message, e := record.Message(DocumentOrdered)
+	if e != nil {
+		doc = append(doc, bson.DocElem{Name: "error", Value: e.Error()}, bson.DocElem{Name: "frame", Value: record.Frame})
+	} else {
+		doc = append(doc, bson.DocElem{Name: "message", Value: MessageDocument(message)})
+	}
+	return ExtendedJSON(doc)
+}
+
+/*
+以有序文档的形式描述一个消息,字段名与协议文档一致
+*/
+func MessageDocument(message UnMarshaler) bson.D {
+	switch m := message.(type) {
+	case *MsgReply:
+		return MessageDocument(m.Msg)
+	case *Msg:
+		sections := make([]interface{}, 0, len(m.Sections))
+		for _, v := range m.Sections {
+			switch section := v.(type) {
+			case *BodyMsgSection:
+				sections = append(sections, bson.D{
+					{Name: "kind", Value: 0},
+					{Name: "body", Value: document(section.BodyD, section.Body, section.BodyRaw)},
+				})
+			case *DocumentSequenceMsgSection:
+				sections = append(sections, bson.D{
+					{Name: "kind", Value: 1},
+					{Name: "identifier", Value: section.DocumentSequenceIdentifier},
+					{Name: "documents", Value: section.documents()},
+				})
+			}
+		}
+		doc := bson.D{{Name: "flagBits", Value: uint32(m.FlatBits)}, {Name: "sections", Value: sections}}
+		if m.FlatBits.Has(ChecksumPresent) {
+			doc = append(doc, bson.DocElem{Name: "checksum", Value: m.Checksum})
+		}
+		return doc
+	case *Query:
+		doc := bson.D{
+			{Name: "flags", Value: int32(m.Flags)},
+			{Name: "fullCollectionName", Value: m.FullCollectionName},
+			{Name: "numberToSkip", Value: m.NumberToSkip},
+			{Name: "numberToReturn", Value: m.NumberToReturn},
+			{Name: "query", Value: document(m.QueryD, m.Query, m.QueryRaw)},
+		}
+		if selector := document(m.ReturnFieldsSelectorD, m.ReturnFieldsSelector, m.ReturnFieldsSelectorRaw); selector != nil {
+			doc = append(doc, bson.DocElem{Name: "returnFieldsSelector", Value: selector})
+		}
+		return doc
+	case *Insert:
+		return bson.D{
+			{Name: "flags", Value: int32(m.Flags)},
+			{Name: "fullCollectionName", Value: m.FullCollectionName},
+			{Name: "documents", Value: documentList(m.DocumentsD, m.Documents, m.DocumentsRaw)},
+		}
+	case *Update:
+		return bson.D{
+			{Name: "flags", Value: int32(m.Flags)},
+			{Name: "fullCollectionName", Value: m.FullCollectionName},
+			{Name: "selector", Value: document(m.SelectorD, m.Selector, m.SelectorRaw)},
+			{Name: "update", Value: document(m.UpdateD, m.Update, m.UpdateRaw)},
+		}
+	case *Delete:
+		return bson.D{
+			{Name: "flags", Value: int32(m.Flags)},
+			{Name: "fullCollectionName", Value: m.FullCollectionName},
+			{Name: "selector", Value: document(m.SelectorD, m.Selector, m.SelectorRaw)},
+		}
+	case *GetMore:
+		var cursorID int64
+		if m.CursorID != nil {
+			cursorID = *m.CursorID
+		}
+		return bson.D{
+			{Name: "fullCollectionName", Value: m.FullCollectionName},
+			{Name: "numberToReturn", Value: m.NumberToReturn},
+			{Name: "cursorId", Value: cursorID},
+		}
+	case *KillCursors:
+		return bson.D{{Name: "cursorIds", Value: m.CursorIDs}}
+	case *Reply:
+		return bson.D{
+			{Name: "responseFlags", Value: int32(m.ResponseFlags)},
+			{Name: "cursorId", Value: m.CursorID},
+			{Name: "startingFrom", Value: m.StartingFrom},
+			{Name: "numberReturned", Value: m.NumberReturned},
+			{Name: "documents", Value: m.Documents},
+		}
+	}
+	return bson.D{}
+}
+
+/*
+单个文档,优先级同marshalDocument,都为空时返回nil
+*/
+func document(d bson.D, m bson.M, raw bson.Raw) interface{} {
+	switch {
+	case d != nil:
+		return d
+	case m != nil:
+		return m
+	case raw.Data != nil:
+		return raw
+	}
+	return nil
+}
+
+/*
+MongoDB Extended JSON(relaxed),bson.D保留key的顺序,bson.M按key排序
+*/
+func ExtendedJSON(v interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if e := writeExtendedJSON(buffer, v); e != nil {
+		return nil, e
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeExtendedJSON(buffer *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case bson.D:
+		buffer.WriteByte('{')
+		for i, elem := range value {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if e := writeJSONKey(buffer, elem.Name); e != nil {
+				return e
+			}
+			if e := writeExtendedJSON(buffer, elem.Value); e != nil {
+				return e
+			}
+		}
+		buffer.WriteByte('}')
+		return nil
+	case bson.M:
+		return writeExtendedJSON(buffer, sortedDocument(value))
+	case map[string]interface{}:
+		return writeExtendedJSON(buffer, sortedDocument(value))
+	case bson.Raw:
+		if value.Kind == bsonDocumentKind {
+			doc := bson.D{}
+			if e := value.Unmarshal(&doc); e != nil {
+				return e
+			}
+			return writeExtendedJSON(buffer, doc)
+		}
+		var out interface{}
+		if e := value.Unmarshal(&out); e != nil {
+			return e
+		}
+		return writeExtendedJSON(buffer, out)
+	case []interface{}:
+		buffer.WriteByte('[')
+		for i, elem := range value {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if e := writeExtendedJSON(buffer, elem); e != nil {
+				return e
+			}
+		}
+		buffer.WriteByte(']')
+		return nil
+	case []bson.D:
+		list := make([]interface{}, 0, len(value))
+		for _, doc := range value {
+			list = append(list, doc)
+		}
+		return writeExtendedJSON(buffer, list)
+	case []bson.M:
+		list := make([]interface{}, 0, len(value))
+		for _, doc := range value {
+			list = append(list, doc)
+		}
+		return writeExtendedJSON(buffer, list)
+	}
+	out, e := bson.MarshalJSON(v)
+	if e != nil {
+		return e
+	}
+	buffer.Write(bytes.TrimRight(out, "\n"))
+	return nil
+}
+
+func writeJSONKey(buffer *bytes.Buffer, key string) error {
+	out, e := json.Marshal(key)
+	if e != nil {
+		return e
+	}
+	buffer.Write(out)
+	buffer.WriteByte(':')
+	return nil
+}
+
+func sortedDocument(m map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		doc = append(doc, bson.DocElem{Name: k, Value: m[k]})
+	}
+	return doc
+}
@@ -3,6 +3,7 @@ module github.com/tangxusc/mongo-protocol
 go 1.13
 
 require (
+	github.com/klauspost/compress v1.11.4
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/sirupsen/logrus v1.4.2
@@ -1,10 +1,8 @@
 package mongo_protocol
 
 import (
-	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
-	"net"
 )
 
 var defaultHandler = &PrintHandler{}
@@ -13,12 +11,21 @@ type Handler interface {
 	Process(header *MsgHeader, r *Reader, conn *ConnContext) error
 }
 
+/*
+将普通函数作为Handler使用,常用于编写中间件
+*/
+type HandlerFunc func(header *MsgHeader, r *Reader, conn *ConnContext) error
+
+func (f HandlerFunc) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	return f(header, r, conn)
+}
+
 type PrintHandler struct {
 }
 
 func (d *PrintHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
 	logrus.Infof(`header:%v`, *header)
-	var data interface{}
+	var data UnMarshaler
 	var e error
 	switch header.OpCode {
 	case OP_QUERY:
@@ -57,11 +64,12 @@ func (d *PrintHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext)
 	if e != nil {
 		return e
 	}
-	bytes, _ := json.Marshal(data)
-	logrus.Infof(`[server]PrintHandler message: %s`, bytes)
+	if data != nil {
+		out, _ := ExtendedJSON(MessageDocument(data))
+		logrus.Infof(`[server]PrintHandler message: %s`, out)
+	}
 	reply := NewReply(header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{"ok": 1}
+	reply.AddDocument(map[string]interface{}{"ok": 1})
 	e = reply.Write(conn)
 	return nil
 }
@@ -70,22 +78,3 @@ type QueryHandler interface {
 	Support(query *Query) bool
 	Process(query *Query, reply *Reply) error
 }
-
-type ConnContext struct {
-	net.Conn
-	m map[string]interface{}
-}
-
-func (c *ConnContext) Set(key string, value interface{}) {
-	c.m[key] = value
-}
-func (c *ConnContext) Get(key string) (value interface{}, ok bool) {
-	value, ok = c.m[key]
-	return
-}
-func NewConnContext(conn net.Conn) *ConnContext {
-	return &ConnContext{
-		Conn: conn,
-		m:    make(map[string]interface{}),
-	}
-}
@@ -0,0 +1,200 @@
+package mongo_protocol
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+驱动建立连接时所需的握手命令:
+hello, isMaster, buildInfo, whatsmyuri, ping, getLastError, getFreeMonitoringStatus, connectionStatus
+MaxBsonObjectSize与MaxMessageSizeBytes为0时告知客户端Server的限制(没有Server时为默认值),
+设置了Server时不会超过Server实际执行的限制
+*/
+type Handshake struct {
+	ServerVersion                string
+	GitVersion                   string
+	MinWireVersion               int32
+	MaxWireVersion               int32
+	MaxBsonObjectSize            int32
+	MaxMessageSizeBytes          int32
+	MaxWriteBatchSize            int32
+	LogicalSessionTimeoutMinutes int32
+	ReadOnly                     bool
+	// 用于协商压缩器与大小限制,为nil时不支持压缩
+	Server *Server
+}
+
+func NewHandshake(server *Server) *Handshake {
+	return &Handshake{
+		ServerVersion:                "4.2.0",
+		GitVersion:                   "a4b751dcf51dd249c5865812b390cfd1c0129c30",
+		MinWireVersion:               0,
+		MaxWireVersion:               8,
+		MaxWriteBatchSize:            100000,
+		LogicalSessionTimeoutMinutes: 30,
+		Server:                       server,
+	}
+}
+
+func (h *Handshake) Register(router *CommandRouter) {
+	router.Handle("hello", h.hello)
+	router.Handle("isMaster", h.isMaster)
+	router.Handle("buildInfo", h.buildInfo)
+	router.Handle("whatsmyuri", h.whatsmyuri)
+	router.Handle("ping", h.ping)
+	router.Handle("getLastError", h.getLastError)
+	router.Handle("getFreeMonitoringStatus", h.getFreeMonitoringStatus)
+	router.Handle("connectionStatus", h.connectionStatus)
+}
+
+func (h *Handshake) hello(cmd *Command) (interface{}, error) {
+	reply := h.helloReply(cmd)
+	reply["isWritablePrimary"] = true
+	return reply, nil
+}
+
+func (h *Handshake) isMaster(cmd *Command) (interface{}, error) {
+	reply := h.helloReply(cmd)
+	reply["ismaster"] = true
+	if helloOk, _ := cmd.Map()["helloOk"].(bool); helloOk {
+		reply["helloOk"] = true
+	}
+	return reply, nil
+}
+
+/*
+告知客户端的大小限制,设置的值大于Server的限制时使用Server的限制
+*/
+func (h *Handshake) limits() (maxBsonObjectSize int32, maxMessageSizeBytes int32) {
+	maxBsonObjectSize, maxMessageSizeBytes = DefaultMaxBsonObjectSize, DefaultMaxMessageSizeBytes
+	if h.Server != nil {
+		maxBsonObjectSize, maxMessageSizeBytes = h.Server.maxBsonObjectSize(), h.Server.maxMessageSize()
+	}
+	if h.MaxBsonObjectSize > 0 && (h.Server == nil || h.MaxBsonObjectSize < maxBsonObjectSize) {
+		maxBsonObjectSize = h.MaxBsonObjectSize
+	}
+	if h.MaxMessageSizeBytes > 0 && (h.Server == nil || h.MaxMessageSizeBytes < maxMessageSizeBytes) {
+		maxMessageSizeBytes = h.MaxMessageSizeBytes
+	}
+	return
+}
+
+func (h *Handshake) helloReply(cmd *Command) bson.M {
+	maxBsonObjectSize, maxMessageSizeBytes := h.limits()
+	reply := bson.M{
+		"maxBsonObjectSize":            maxBsonObjectSize,
+		"maxMessageSizeBytes":          maxMessageSizeBytes,
+		"maxWriteBatchSize":            h.MaxWriteBatchSize,
+		"localTime":                    time.Now(),
+		"logicalSessionTimeoutMinutes": h.LogicalSessionTimeoutMinutes,
+		"connectionId":                 cmd.Conn.ID(),
+		"minWireVersion":               h.MinWireVersion,
+		"maxWireVersion":               h.MaxWireVersion,
+		"readOnly":                     h.ReadOnly,
+		"ok":                           1.0,
+	}
+	doc := cmd.Map()
+	//与mongod一样只记录第一次握手时的client
+	if client, ok := doc["client"].(bson.M); ok && cmd.Conn.ClientMetadata() == nil {
+		cmd.Conn.SetClientMetadata(NewClientMetadata(client))
+	}
+	if h.Server != nil {
+		requested := make([]string, 0)
+		if list, ok := doc["compression"].([]interface{}); ok {
+			for _, v := range list {
+				if name, ok := v.(string); ok {
+					requested = append(requested, name)
+				}
+			}
+		}
+		if compression := h.Server.NegotiateCompression(requested); len(compression) > 0 {
+			cmd.Conn.SetCompression(compression)
+			reply["compression"] = compression
+		}
+	}
+	return reply
+}
+
+func (h *Handshake) buildInfo(cmd *Command) (interface{}, error) {
+	maxBsonObjectSize, _ := h.limits()
+	return bson.M{
+		"version":           h.ServerVersion,
+		"gitVersion":        h.GitVersion,
+		"versionArray":      versionArray(h.ServerVersion),
+		"modules":           make([]string, 0),
+		"allocator":         "system",
+		"javascriptEngine":  "none",
+		"sysInfo":           "deprecated",
+		"bits":              64,
+		"debug":             false,
+		"maxBsonObjectSize": maxBsonObjectSize,
+		"storageEngines":    make([]string, 0),
+		"ok":                1.0,
+	}, nil
+}
+
+func (h *Handshake) whatsmyuri(cmd *Command) (interface{}, error) {
+	return bson.M{"you": cmd.Conn.RemoteAddr().String(), "ok": 1.0}, nil
+}
+
+func (h *Handshake) ping(cmd *Command) (interface{}, error) {
+	return bson.M{"ok": 1.0}, nil
+}
+
+/*
+返回连接上最近一次旧版写操作的结果
+*/
+func (h *Handshake) getLastError(cmd *Command) (interface{}, error) {
+	reply := bson.M{
+		"connectionId": cmd.Conn.ID(),
+		"n":            0,
+		"syncMillis":   0,
+		"writtenTo":    nil,
+		"err":          nil,
+		"ok":           1.0,
+	}
+	if lastError := cmd.Conn.LastError(); lastError != nil {
+		reply["n"] = lastError.N
+		if lastError.Err != nil {
+			reply["err"] = lastError.Err.Message
+			reply["code"] = lastError.Err.Code
+			if lastError.Err.CodeName != "" {
+				reply["codeName"] = lastError.Err.CodeName
+			}
+		}
+	}
+	return reply, nil
+}
+
+func (h *Handshake) getFreeMonitoringStatus(cmd *Command) (interface{}, error) {
+	return bson.M{"state": "disabled", "ok": 1.0}, nil
+}
+
+func (h *Handshake) connectionStatus(cmd *Command) (interface{}, error) {
+	users := make([]interface{}, 0)
+	if user := cmd.Conn.User(); user != nil {
+		users = append(users, bson.M{"user": user.User, "db": user.DB})
+	}
+	return bson.M{
+		"authInfo": bson.M{
+			"authenticatedUsers":     users,
+			"authenticatedUserRoles": make([]interface{}, 0),
+		},
+		"ok": 1.0,
+	}, nil
+}
+
+/*
+"4.2.0" -> [4,2,0,0]
+*/
+func versionArray(version string) []int32 {
+	result := make([]int32, 4)
+	for i, v := range strings.SplitN(version, ".", 4) {
+		n, _ := strconv.Atoi(strings.SplitN(v, "-", 2)[0])
+		result[i] = int32(n)
+	}
+	return result
+}
@@ -0,0 +1,65 @@
+package mongo_protocol
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"testing"
+)
+
+func newHandshakeTestConn(server *Server) net.Conn {
+	client, conn := net.Pipe()
+	go server.handler(context.TODO(), conn)
+	return client
+}
+
+func TestHandshake(t *testing.T) {
+	server := NewServer(`0`)
+	_ = server.SetCompressors("zstd", "zlib")
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	server.AddHandler(OP_MSG, router)
+	server.AddHandler(OP_QUERY, router)
+
+	first := newHandshakeTestConn(server)
+	defer first.Close()
+	sendTestQuery(t, first, 1, "admin.$cmd", bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "helloOk", Value: true},
+		{Name: "compression", Value: []string{"snappy", "zlib"}},
+	})
+	_, reply := readTestReply(t, first)
+	if reply["ismaster"] != true || reply["helloOk"] != true || reply["maxWireVersion"] != 8 {
+		t.Fatalf("unexpected isMaster reply %v", reply)
+	}
+	compression, _ := reply["compression"].([]interface{})
+	if len(compression) != 1 || compression[0] != "zlib" {
+		t.Fatalf("unexpected compression %v", reply["compression"])
+	}
+	firstID, _ := reply["connectionId"].(int64)
+
+	second := newHandshakeTestConn(server)
+	defer second.Close()
+	sendTestMsg(t, second, 2, 0, bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg := readTestMsg(t, second)
+	body := msg.GetBodyMsgSection()
+	if body["isWritablePrimary"] != true || body["compression"] != nil {
+		t.Fatalf("unexpected hello reply %v", body)
+	}
+	if secondID, _ := body["connectionId"].(int64); secondID <= firstID {
+		t.Fatalf("connectionId should increase: %d then %d", firstID, secondID)
+	}
+
+	sendTestMsg(t, second, 3, 0, bson.D{{Name: "whatsmyuri", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, second)
+	if msg.GetBodyMsgSection()["you"] != "pipe" {
+		t.Fatalf("unexpected whatsmyuri reply %v", msg.GetBodyMsgSection())
+	}
+
+	sendTestMsg(t, second, 4, 0, bson.D{{Name: "buildinfo", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, second)
+	versions, _ := msg.GetBodyMsgSection()["versionArray"].([]interface{})
+	if msg.GetBodyMsgSection()["version"] != "4.2.0" || len(versions) != 4 || versions[1] != 2 {
+		t.Fatalf("unexpected buildInfo reply %v", msg.GetBodyMsgSection())
+	}
+}
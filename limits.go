@@ -0,0 +1,152 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+连接统计,Dropped*为因对应原因被服务端关闭的连接数
+*/
+type ServerStats struct {
+	// 当前连接数
+	Connections int64
+	// 累计接受的连接数(不含被拒绝的连接)
+	TotalConnections int64
+	// 超过MaxConnections被拒绝的连接
+	DroppedMaxConnections int64
+	// 超过IdleTimeout没有新请求
+	DroppedIdle int64
+	// 超过ReadTimeout没有读完一个消息,或TLS握手超时
+	DroppedReadTimeout int64
+	// 超过WriteTimeout没有写完回复
+	DroppedWriteTimeout int64
+}
+
+func (server *Server) Stats() ServerStats {
+	server.lock.Lock()
+	connections := int64(len(server.conns))
+	server.lock.Unlock()
+	return ServerStats{
+		Connections:           connections,
+		TotalConnections:      atomic.LoadInt64(&server.stats.TotalConnections),
+		DroppedMaxConnections: atomic.LoadInt64(&server.stats.DroppedMaxConnections),
+		DroppedIdle:           atomic.LoadInt64(&server.stats.DroppedIdle),
+		DroppedReadTimeout:    atomic.LoadInt64(&server.stats.DroppedReadTimeout),
+		DroppedWriteTimeout:   atomic.LoadInt64(&server.stats.DroppedWriteTimeout),
+	}
+}
+
+/*
+MaxConnections对应的信号量,在第一次使用时按当时的MaxConnections创建
+*/
+func (server *Server) connectionSlots() chan struct{} {
+	server.slotsOnce.Do(func() {
+		if server.MaxConnections > 0 {
+			server.slots = make(chan struct{}, server.MaxConnections)
+		}
+	})
+	return server.slots
+}
+
+/*
+QueueExcessConnections时已Accept的连接等待空闲的连接数,服务关闭时返回false
+*/
+func (server *Server) waitConnectionSlot(ctx context.Context) bool {
+	slots := server.connectionSlots()
+	if slots == nil || !server.QueueExcessConnections {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+	case <-server.shutdownCh:
+	}
+	return false
+}
+
+/*
+Accept之后占用一个连接数,超过MaxConnections时关闭连接
+*/
+func (server *Server) acquireConnectionSlot(conn net.Conn) bool {
+	slots := server.connectionSlots()
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		atomic.AddInt64(&server.stats.DroppedMaxConnections, 1)
+		_ = conn.Close()
+		return false
+	}
+}
+
+func (server *Server) releaseConnectionSlot() {
+	if slots := server.connectionSlots(); slots != nil {
+		<-slots
+	}
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func isTimeout(e error) bool {
+	ne, ok := e.(net.Error)
+	return ok && ne.Timeout()
+}
+
+/*
+读取一个请求:等待第一个字节最多IdleTimeout,之后读完整个消息最多ReadTimeout;
+收到第一个字节后连接即为活跃状态,Shutdown会等待该请求读完并处理
+*/
+func (server *Server) readRequest(connContext *ConnContext) (*MsgHeader, []byte, error) {
+	var first [1]byte
+	_ = connContext.SetReadDeadline(deadline(server.IdleTimeout))
+	if _, e := io.ReadFull(connContext, first[:]); e != nil {
+		if isTimeout(e) {
+			atomic.AddInt64(&server.stats.DroppedIdle, 1)
+		}
+		return nil, nil, e
+	}
+	if !server.setConnState(connContext, true) {
+		return nil, nil, ErrServerClosed
+	}
+	_ = connContext.SetReadDeadline(deadline(server.ReadTimeout))
+	header, body, e := readMessageLimit(io.MultiReader(bytes.NewReader(first[:]), connContext), server.maxMessageSize())
+	if e != nil && isTimeout(e) {
+		atomic.AddInt64(&server.stats.DroppedReadTimeout, 1)
+	}
+	return header, body, e
+}
+
+func (server *Server) maxMessageSize() int32 {
+	if server.MaxMessageSizeBytes > 0 {
+		return server.MaxMessageSizeBytes
+	}
+	return DefaultMaxMessageSizeBytes
+}
+
+func (server *Server) maxBsonObjectSize() int32 {
+	if server.MaxBsonObjectSize > 0 {
+		return server.MaxBsonObjectSize
+	}
+	return DefaultMaxBsonObjectSize
+}
+
+func (server *Server) tlsHandshakeTimeout() time.Duration {
+	if server.TLSHandshakeTimeout > 0 {
+		return server.TLSHandshakeTimeout
+	}
+	return DefaultTLSHandshakeTimeout
+}
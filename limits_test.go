@@ -0,0 +1,339 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startLimitsTestServer(t *testing.T, server *Server) string {
+	listener, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, e := conn.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected connection closed by server, got %v", e)
+	}
+}
+
+func waitStats(t *testing.T, server *Server, ok func(stats ServerStats) bool) ServerStats {
+	for i := 0; i < 200; i++ {
+		if stats := server.Stats(); ok(stats) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := server.Stats()
+	t.Fatalf("unexpected stats %+v", stats)
+	return stats
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.MaxConnections = 1
+	addr := startLimitsTestServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	first, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sendTestMsg(t, first, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	readTestMsg(t, first)
+	second, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer second.Close()
+	expectClosed(t, second)
+	waitStats(t, server, func(stats ServerStats) bool {
+		return stats.DroppedMaxConnections == 1 && stats.TotalConnections == 1
+	})
+
+	first.Close()
+	waitStats(t, server, func(stats ServerStats) bool {
+		return stats.Connections == 0
+	})
+	third, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	pingTestServer(t, third)
+}
+
+func TestMaxConnectionsQueue(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.MaxConnections = 1
+	server.QueueExcessConnections = true
+	addr := startLimitsTestServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	first, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer first.Close()
+	sendTestMsg(t, first, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	readTestMsg(t, first)
+
+	second, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer second.Close()
+	sendTestMsg(t, second, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	_ = second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, e := second.Read(make([]byte, 1)); !isTimeout(e) {
+		t.Fatalf("expected queued connection without reply, got %v", e)
+	}
+	first.Close()
+	_ = second.SetReadDeadline(time.Time{})
+	if _, msg := readTestMsg(t, second); msg.GetBodyMsgSection()["ok"] != 1.0 {
+		t.Fatalf("unexpected reply %v", msg.GetBodyMsgSection())
+	}
+	if stats := server.Stats(); stats.DroppedMaxConnections != 0 || stats.TotalConnections != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+/*
+多个listener共用连接数,空闲的listener不会占用连接数
+*/
+func TestMaxConnectionsQueueListeners(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.MaxConnections = 1
+	server.QueueExcessConnections = true
+	first := startLimitsTestServer(t, server)
+	second := startLimitsTestServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	ping := func(conn net.Conn, timeout time.Duration) error {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		sendTestMsg(t, conn, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+		_, _, e := readMessage(conn)
+		return e
+	}
+	busy, e := net.Dial(`tcp`, second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer busy.Close()
+	if e := ping(busy, 5*time.Second); e != nil {
+		t.Fatalf("second listener should be served: %v", e)
+	}
+	queued, e := net.Dial(`tcp`, first)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer queued.Close()
+	if e := ping(queued, 100*time.Millisecond); !isTimeout(e) {
+		t.Fatalf("expected queued connection without reply, got %v", e)
+	}
+	busy.Close()
+	_ = queued.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, _, e := readMessage(queued); e != nil {
+		t.Fatalf("queued connection should be served: %v", e)
+	}
+}
+
+func TestIdleAndReadTimeout(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.IdleTimeout = 50 * time.Millisecond
+	server.ReadTimeout = 50 * time.Millisecond
+	addr := startLimitsTestServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	idle, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer idle.Close()
+	expectClosed(t, idle)
+
+	slow, e := net.Dial(`tcp`, addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer slow.Close()
+	if _, e := slow.Write([]byte{0x20, 0, 0}); e != nil {
+		t.Fatal(e)
+	}
+	expectClosed(t, slow)
+	waitStats(t, server, func(stats ServerStats) bool {
+		return stats.DroppedIdle == 1 && stats.DroppedReadTimeout == 1
+	})
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.WriteTimeout = 50 * time.Millisecond
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		server.handler(context.TODO(), conn)
+		close(done)
+	}()
+	// 发送请求后不读取回复
+	sendTestMsg(t, client, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed after write timeout")
+	}
+	if stats := server.Stats(); stats.DroppedWriteTimeout != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.MaxMessageSizeBytes = 64 * 1024
+	for _, c := range []struct {
+		header MsgHeader
+		code   int32
+	}{
+		{MsgHeader{MessageLength: 128 * 1024, RequestID: 5, OpCode: OP_MSG}, CodeProtocolError},
+		{MsgHeader{MessageLength: -1, RequestID: 6, OpCode: OP_QUERY}, CodeProtocolError},
+	} {
+		client, conn := net.Pipe()
+		go server.handler(context.TODO(), conn)
+		if e := binary.Write(client, binary.LittleEndian, &c.header); e != nil {
+			t.Fatal(e)
+		}
+		header, data, e := readMessage(client)
+		if e != nil {
+			t.Fatal(e)
+		}
+		message, e := ParseMessage(header, data, DocumentMap)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var body bson.M
+		switch reply := message.(type) {
+		case *MsgReply:
+			body = reply.GetBodyMsgSection()
+		case *Reply:
+			if !reply.ResponseFlags.Has(QueryFailure) {
+				t.Fatalf("expected QueryFailure, got %b", reply.ResponseFlags)
+			}
+			body = reply.Documents[0].(bson.M)
+		}
+		if header.ResponseTo != c.header.RequestID || body["code"] != int(c.code) {
+			t.Fatalf("unexpected error reply %v %v", *header, body)
+		}
+		expectClosed(t, client)
+		client.Close()
+	}
+}
+
+func TestDocumentSizeLimit(t *testing.T) {
+	server := newListenerTestServer(``)
+	server.MaxBsonObjectSize = 1024
+	server.MaxMessageSizeBytes = 64 * 1024
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	big := strings.Repeat("x", 32*1024)
+	sendTestMsg(t, client, 1, 0, bson.D{{Name: "ping", Value: 1}, {Name: "pad", Value: big}, {Name: "$db", Value: "admin"}})
+	_, msg := readTestMsg(t, client)
+	if body := msg.GetBodyMsgSection(); body["code"] != int(CodeBSONObjectTooLarge) {
+		t.Fatalf("unexpected reply %v", body)
+	}
+
+	sendTestMsg(t, client, 2, 0, bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, client)
+	if body := msg.GetBodyMsgSection(); body["maxBsonObjectSize"] != 1024 || body["maxMessageSizeBytes"] != 64*1024 {
+		t.Fatalf("unexpected hello %v", body)
+	}
+}
+
+func TestReadOneRejectsInvalidLength(t *testing.T) {
+	for _, length := range []int32{0, -1, 0x7fffffff} {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(length))
+		r := &Reader{Reader: bytes.NewReader(data)}
+		if _, e := r.ReadOne(); e == nil {
+			t.Fatalf("expected error for length %d", length)
+		} else if _, ok := e.(*SizeError); !ok {
+			t.Fatalf("expected SizeError for length %d, got %v", length, e)
+		}
+	}
+}
+
+func TestHandshakeLimits(t *testing.T) {
+	server := NewServer(`0`)
+	server.MaxBsonObjectSize = 1024
+	h := NewHandshake(server)
+	if b, m := h.limits(); b != 1024 || m != DefaultMaxMessageSizeBytes {
+		t.Fatalf("unexpected limits %d %d", b, m)
+	}
+	//不会告知客户端比Server更大的限制
+	h.MaxBsonObjectSize, h.MaxMessageSizeBytes = 2048, 1024*1024
+	if b, m := h.limits(); b != 1024 || m != 1024*1024 {
+		t.Fatalf("unexpected limits %d %d", b, m)
+	}
+	h.Server = nil
+	if b, m := h.limits(); b != 2048 || m != 1024*1024 {
+		t.Fatalf("unexpected limits %d %d", b, m)
+	}
+}
+
+/*
+只有命令文档可以超过MaxDocumentSize 16KB,插入的文档不可以
+*/
+func TestCommandSizeSlack(t *testing.T) {
+	doc := bson.D{{Name: "pad", Value: strings.Repeat("x", 2048)}}
+	msg := &Msg{Header: &MsgHeader{}, Sections: []MsgSection{
+		&BodyMsgSection{Kind: 0, BodyD: bson.D{{Name: "insert", Value: "c"}, {Name: "doc", Value: doc}}},
+	}}
+	buffer := &bytes.Buffer{}
+	if e := msg.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, body, e := readMessage(buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := (&Msg{}).UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header, MaxDocumentSize: 1024}); e != nil {
+		t.Fatalf("command body should use the slack: %v", e)
+	}
+
+	msg.Sections = []MsgSection{
+		&BodyMsgSection{Kind: 0, BodyD: bson.D{{Name: "insert", Value: "c"}}},
+		&DocumentSequenceMsgSection{Kind: 1, DocumentSequenceIdentifier: "documents", DocumentSequencesD: []bson.D{doc}},
+	}
+	buffer.Reset()
+	if e := msg.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, body, _ = readMessage(buffer)
+	e = (&Msg{}).UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header, MaxDocumentSize: 1024})
+	if _, ok := e.(*SizeError); !ok {
+		t.Fatalf("expected SizeError for document sequence, got %v", e)
+	}
+
+	insert := &Insert{FullCollectionName: "db.c", DocumentsD: []bson.D{doc}}
+	buffer.Reset()
+	if e := insert.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, body, _ = readMessage(buffer)
+	e = (&Insert{}).UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header, MaxDocumentSize: 1024})
+	if _, ok := e.(*SizeError); !ok {
+		t.Fatalf("expected SizeError for OP_INSERT, got %v", e)
+	}
+}
@@ -0,0 +1,91 @@
+package mongo_protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+/*
+mongod默认的unix socket路径,如 /tmp/mongodb-27017.sock
+*/
+func DefaultUnixSocketPath(port string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mongodb-%s.sock", port))
+}
+
+type pipeAddr struct {
+}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
+
+/*
+内存中的listener,Dial返回net.Pipe的一端,另一端由Accept返回;
+用于测试或在同一进程内嵌入服务,不经过网络
+*/
+type PipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *PipeListener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background())
+}
+
+/*
+建立连接,直到连接被Accept或ctx结束
+*/
+func (l *PipeListener) DialContext(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	var e error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		e = ErrListenerClosed
+	case <-ctx.Done():
+		e = ctx.Err()
+	}
+	_ = client.Close()
+	_ = server.Close()
+	return nil, e
+}
@@ -0,0 +1,104 @@
+package mongo_protocol
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newListenerTestServer(port string) *Server {
+	server := NewServer(port)
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	server.AddHandler(OP_MSG, router)
+	return server
+}
+
+func pingTestServer(t *testing.T, conn net.Conn) {
+	client := NewClient(conn)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, e := client.RunCommand(ctx, "admin", bson.D{{Name: "ping", Value: 1}}); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestServePipeListener(t *testing.T) {
+	server := newListenerTestServer(``)
+	listener := NewPipeListener()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	conn, e := listener.Dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	pingTestServer(t, conn)
+
+	listener.Close()
+	if e := <-served; e != ErrListenerClosed {
+		t.Fatalf("expected ErrListenerClosed, got %v", e)
+	}
+	if _, e := listener.Dial(); e != ErrListenerClosed {
+		t.Fatalf("expected ErrListenerClosed, got %v", e)
+	}
+}
+
+func TestStartUnixSocketAndBindAddress(t *testing.T) {
+	dir, e := ioutil.TempDir("", "mongo-unix")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	server := newListenerTestServer(`0`)
+	server.BindAddress = "127.0.0.1"
+	server.UnixSocketPath = filepath.Join(dir, "mongodb-0.sock")
+	// 残留的socket文件会被删除
+	if e := ioutil.WriteFile(server.UnixSocketPath, nil, 0600); e != nil {
+		t.Fatal(e)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start(ctx)
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.lock.Lock()
+		addrs = addrs[:0]
+		for listener := range server.listeners {
+			addrs = append(addrs, listener.Addr())
+		}
+		server.lock.Unlock()
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 listeners, got %v", addrs)
+	}
+	for _, addr := range addrs {
+		if tcp, ok := addr.(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+			t.Fatalf("expected loopback address, got %v", tcp)
+		}
+		conn, e := net.Dial(addr.Network(), addr.String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		pingTestServer(t, conn)
+	}
+
+	cancel()
+	if e := <-started; e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(server.UnixSocketPath); !os.IsNotExist(e) {
+		t.Fatalf("expected socket file removed, got %v", e)
+	}
+}
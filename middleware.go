@@ -0,0 +1,101 @@
+package mongo_protocol
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const requestIDKey = "middleware.requestId"
+
+var lastRequestSeq int64
+
+/*
+为每个请求分配一个进程内唯一的id,可通过RequestID获取,用于关联日志
+*/
+func RequestIDMiddleware(next Handler) Handler {
+	return HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+		conn.Set(requestIDKey, atomic.AddInt64(&lastRequestSeq, 1))
+		defer conn.Delete(requestIDKey)
+		return next.Process(header, r, conn)
+	})
+}
+
+/*
+当前请求的id,没有使用RequestIDMiddleware时返回0
+*/
+func RequestID(conn *ConnContext) int64 {
+	if v, ok := conn.Get(requestIDKey); ok {
+		return v.(int64)
+	}
+	return 0
+}
+
+/*
+记录每个请求的opCode,连接,耗时与错误
+*/
+func LoggingMiddleware(next Handler) Handler {
+	return HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+		start := time.Now()
+		e := next.Process(header, r, conn)
+		entry := logrus.WithFields(logrus.Fields{
+			"opCode":       opCodeName(header.OpCode),
+			"requestId":    header.RequestID,
+			"connectionId": conn.ID(),
+			"elapsed":      time.Since(start),
+		})
+		if id := RequestID(conn); id != 0 {
+			entry = entry.WithField("id", id)
+		}
+		if e != nil {
+			entry.Warnf("[server]request error:%v", e)
+		} else {
+			entry.Infof("[server]request done")
+		}
+		return e
+	})
+}
+
+/*
+将Handler中的panic转换为错误返回,由Server按请求的opCode回复错误
+*/
+func RecoverMiddleware(next Handler) Handler {
+	return HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) (e error) {
+		defer func() {
+			if v := recover(); v != nil {
+				logrus.Errorf("[server]panic:%v\n%s", v, debug.Stack())
+				if err, ok := v.(error); ok {
+					e = err
+				} else {
+					e = fmt.Errorf("%v", v)
+				}
+			}
+		}()
+		return next.Process(header, r, conn)
+	})
+}
+
+/*
+统计每个请求的耗时,observe在请求处理完成后调用,可用于上报指标
+*/
+func TimingMiddleware(observe func(header *MsgHeader, conn *ConnContext, elapsed time.Duration, e error)) func(Handler) Handler {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+			start := time.Now()
+			e := next.Process(header, r, conn)
+			observe(header, conn, time.Since(start), e)
+			return e
+		})
+	}
+}
+
+/*
+以中间件的形式使用RecordHandler
+*/
+func RecordMiddleware(capture *CaptureWriter) func(Handler) Handler {
+	return func(next Handler) Handler {
+		return NewRecordHandler(next, capture)
+	}
+}
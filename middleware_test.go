@@ -0,0 +1,62 @@
+package mongo_protocol
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerUse(t *testing.T) {
+	server := NewServer(`0`)
+	order := make([]string, 0)
+	trace := func(name string) func(Handler) Handler {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+				order = append(order, name)
+				return next.Process(header, r, conn)
+			})
+		}
+	}
+	timings := make(chan error, 2)
+	server.Use(trace("first"), trace("second"), RecoverMiddleware, RequestIDMiddleware, LoggingMiddleware)
+	server.Use(TimingMiddleware(func(header *MsgHeader, conn *ConnContext, elapsed time.Duration, e error) {
+		timings <- e
+	}))
+	server.SetDefaultHandler(HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+		msg := &Msg{}
+		if e := msg.UnMarshal(r); e != nil {
+			return e
+		}
+		if _, ok := msg.GetBodyMsgSection()["panic"]; ok {
+			panic("handler panic")
+		}
+		reply := NewMsgReply(header.RequestID)
+		section := NewBodyMsgSection()
+		section.Body = bson.M{"id": RequestID(conn), "ok": 1.0}
+		reply.Sections = append(reply.Sections, section)
+		return reply.Write(conn)
+	}))
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestMsg(t, client, 1, 0, bson.M{"ping": 1})
+	_, msg := readTestMsg(t, client)
+	if id, _ := msg.GetBodyMsgSection()["id"].(int64); id == 0 {
+		t.Fatalf("expected request id, got %v", msg.GetBodyMsgSection())
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("unexpected middleware order %v", order)
+	}
+	if e := <-timings; e != nil {
+		t.Fatalf("unexpected error %v", e)
+	}
+
+	sendTestMsg(t, client, 2, 0, bson.M{"panic": 1})
+	_, msg = readTestMsg(t, client)
+	if body := msg.GetBodyMsgSection(); body["ok"] != 0.0 || body["errmsg"] != "handler panic" {
+		t.Fatalf("unexpected error reply %v", body)
+	}
+}
@@ -3,7 +3,9 @@ package mongo_protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 )
@@ -36,68 +38,30 @@ struct OP_MSG {
 
 type MsgReply struct {
 	*Msg
-	Header *MsgHeader
 }
 
 func NewMsgReply(requestID int32) *MsgReply {
 	return &MsgReply{
-		Header: &MsgHeader{
-			MessageLength: 0,
-			ResponseTo:    requestID,
-			OpCode:        OP_MSG,
-		},
 		Msg: &Msg{
+			Header: &MsgHeader{
+				MessageLength: 0,
+				ResponseTo:    requestID,
+				OpCode:        OP_MSG,
+			},
 			Sections: make([]MsgSection, 0),
 		},
 	}
 }
 
 func (m *MsgReply) Write(w io.Writer) error {
-	buffer := &bytes.Buffer{}
-	if e := binary.Write(buffer, binary.LittleEndian, m.FlatBits); e != nil {
-		return e
-	}
-	for _, v := range m.Sections {
-		if _, e := buffer.Write([]byte{v.GetKind()}); e != nil {
-			return e
-		}
-		body, ok := v.(*BodyMsgSection)
-		if ok {
-			if out, e := bson.Marshal(body.Body); e != nil {
-				return e
-			} else {
-				if _, e = buffer.Write(out); e != nil {
-					return e
-				}
-			}
-		} else {
-			section := v.(*DocumentSequenceMsgSection)
-			if e := binary.Write(buffer, binary.LittleEndian, section.Size); e != nil {
-				return e
-			}
-			if _, e := buffer.Write([]byte(section.DocumentSequenceIdentifier)); e != nil {
-				return e
-			}
-			for _, doc := range section.DocumentSequences {
-				if out, e := bson.Marshal(doc); e != nil {
-					return e
-				} else {
-					if _, e = buffer.Write(out); e != nil {
-						return e
-					}
-				}
-			}
-		}
-	}
+	return m.Msg.Write(w)
+}
 
-	m.Header.MessageLength = int32(4*4 + buffer.Len())
-	if e := binary.Write(w, binary.LittleEndian, m.Header); e != nil {
-		return e
-	}
-	if _, e := w.Write(buffer.Bytes()); e != nil {
-		return e
+func (m *MsgReply) UnMarshal(r *Reader) error {
+	if m.Msg == nil {
+		m.Msg = &Msg{}
 	}
-	return nil
+	return m.Msg.UnMarshal(r)
 }
 
 type DocumentSequenceMsgSection struct {
@@ -105,6 +69,12 @@ type DocumentSequenceMsgSection struct {
 	Size                       int32
 	DocumentSequenceIdentifier string
 	DocumentSequences          []bson.M
+	DocumentSequencesD         []bson.D
+	DocumentSequencesRaw       []bson.Raw
+}
+
+func (d *DocumentSequenceMsgSection) documents() []interface{} {
+	return documentList(d.DocumentSequencesD, d.DocumentSequences, d.DocumentSequencesRaw)
 }
 
 func NewDocumentSequenceMsgSection() *DocumentSequenceMsgSection {
@@ -116,8 +86,10 @@ func (d *DocumentSequenceMsgSection) GetKind() byte {
 }
 
 type BodyMsgSection struct {
-	Kind byte
-	Body bson.M
+	Kind    byte
+	Body    bson.M
+	BodyD   bson.D
+	BodyRaw bson.Raw
 }
 
 func NewBodyMsgSection() *BodyMsgSection {
@@ -129,15 +101,137 @@ func (b *BodyMsgSection) GetKind() byte {
 }
 
 type Msg struct {
-	FlatBits uint32
+	// standard message header, filled in when decoding with Reader.Header
+	Header   *MsgHeader
+	FlatBits MsgFlags
 	Sections []MsgSection
+	// CRC-32C of the message, only present when FlatBits has ChecksumPresent
+	Checksum uint32
+}
+
+type MsgFlags uint32
+
+const (
+	// the message ends with a CRC-32C checksum
+	ChecksumPresent MsgFlags = 1 << 0
+	// another message will follow this one without further action from the receiver
+	MoreToCome MsgFlags = 1 << 1
+	// the client is prepared for multiple replies to this request using moreToCome
+	ExhaustAllowed MsgFlags = 1 << 16
+)
+
+func (f MsgFlags) Has(flag MsgFlags) bool {
+	return f&flag != 0
+}
+
+func (f *MsgFlags) Set(flag MsgFlags) {
+	*f |= flag
+}
+
+func (f *MsgFlags) Clear(flag MsgFlags) {
+	*f &^= flag
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type ChecksumError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (c *ChecksumError) Error() string {
+	return fmt.Sprintf("OP_MSG checksum mismatch: expected %08x, actual %08x", c.Expected, c.Actual)
+}
+
+/*
+checksum覆盖header,flagBits及全部section
+*/
+func checksum(header *MsgHeader, flagBits MsgFlags, sections []byte) uint32 {
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, header)
+	_ = binary.Write(buffer, binary.LittleEndian, flagBits)
+	buffer.Write(sections)
+	return crc32.Checksum(buffer.Bytes(), castagnoli)
+}
+
+func verifyChecksum(header *MsgHeader, flagBits MsgFlags, sections []byte, expected uint32) error {
+	actual := checksum(header, flagBits, sections)
+	if actual != expected {
+		return &ChecksumError{Expected: expected, Actual: actual}
+	}
+	return nil
 }
 
 type MsgSection interface {
 	GetKind() byte
 }
 
+func (m *Msg) GetHeader() *MsgHeader {
+	if m.Header == nil {
+		m.Header = &MsgHeader{OpCode: OP_MSG}
+	}
+	return m.Header
+}
+
+func (m *Msg) Write(w io.Writer) error {
+	if m.Header == nil {
+		m.Header = &MsgHeader{}
+	}
+	m.Header.OpCode = OP_MSG
+	buffer := &bytes.Buffer{}
+	if e := binary.Write(buffer, binary.LittleEndian, m.FlatBits); e != nil {
+		return e
+	}
+	for _, v := range m.Sections {
+		if _, e := buffer.Write([]byte{v.GetKind()}); e != nil {
+			return e
+		}
+		body, ok := v.(*BodyMsgSection)
+		if ok {
+			if out, e := marshalDocument(body.BodyD, body.Body, body.BodyRaw); e != nil {
+				return e
+			} else {
+				if _, e = buffer.Write(out); e != nil {
+					return e
+				}
+			}
+		} else {
+			section := v.(*DocumentSequenceMsgSection)
+			//size包含自身的4个字节,identifier为cstring
+			sequence := &bytes.Buffer{}
+			sequence.WriteString(section.DocumentSequenceIdentifier)
+			sequence.WriteByte(CStringEndByte)
+			for _, doc := range section.documents() {
+				if out, e := bson.Marshal(doc); e != nil {
+					return e
+				} else {
+					sequence.Write(out)
+				}
+			}
+			section.Size = int32(4 + sequence.Len())
+			if e := binary.Write(buffer, binary.LittleEndian, section.Size); e != nil {
+				return e
+			}
+			if _, e := buffer.Write(sequence.Bytes()); e != nil {
+				return e
+			}
+		}
+	}
+
+	if m.FlatBits.Has(ChecksumPresent) {
+		m.Header.MessageLength = int32(4*4 + buffer.Len() + 4)
+		m.Checksum = checksum(m.Header, m.FlatBits, buffer.Bytes()[4:])
+		if e := binary.Write(buffer, binary.LittleEndian, m.Checksum); e != nil {
+			return e
+		}
+	}
+	return writeMessage(w, m.Header, buffer.Bytes())
+}
+
 func (m *Msg) UnMarshal(r *Reader) error {
+	if r.Header != nil {
+		m.Header = r.Header
+	}
 	m.Sections = make([]MsgSection, 0)
 	defer func() {
 		_, _ = ioutil.ReadAll(r)
@@ -146,7 +240,24 @@ func (m *Msg) UnMarshal(r *Reader) error {
 	if e != nil {
 		return e
 	}
-	m.FlatBits = uint32(flat)
+	m.FlatBits = MsgFlags(flat)
+	if m.FlatBits.Has(ChecksumPresent) {
+		rest, e := ioutil.ReadAll(r)
+		if e != nil {
+			return e
+		}
+		if len(rest) < 4 {
+			return io.ErrUnexpectedEOF
+		}
+		m.Checksum = binary.LittleEndian.Uint32(rest[len(rest)-4:])
+		rest = rest[:len(rest)-4]
+		if r.Header != nil {
+			if e := verifyChecksum(r.Header, m.FlatBits, rest, m.Checksum); e != nil {
+				return e
+			}
+		}
+		r = &Reader{Reader: bytes.NewReader(rest), Header: r.Header, Mode: r.Mode, MaxDocumentSize: r.MaxDocumentSize}
+	}
 	for {
 		kindBytes, e := r.ReadBytes(1)
 		if kindBytes == nil || e != nil {
@@ -155,27 +266,32 @@ func (m *Msg) UnMarshal(r *Reader) error {
 		kind := kindBytes[0]
 		switch kind {
 		case 0:
-			document, e := r.ReadDocument()
+			document, documentD, raw, e := r.readCommandAs()
 			if e != nil {
 				return e
 			}
 			m.Sections = append(m.Sections, &BodyMsgSection{
-				Kind: kind,
-				Body: document,
+				Kind:    kind,
+				Body:    document,
+				BodyD:   documentD,
+				BodyRaw: raw,
 			})
 		case 1:
 			size, e := r.ReadInt32()
 			if e != nil {
 				return e
 			}
-			reader := io.LimitReader(r, int64(size))
-			secReader := &Reader{reader}
+			if size < 4 {
+				return fmt.Errorf("invalid document sequence size %d", size)
+			}
+			reader := io.LimitReader(r, int64(size-4))
+			secReader := &Reader{Reader: reader, Mode: r.Mode, MaxDocumentSize: r.MaxDocumentSize}
 
 			ident, e := secReader.ReadCString()
 			if e != nil {
 				return e
 			}
-			documents, e := secReader.ReadDocuments()
+			documents, documentsD, raws, e := secReader.readDocumentsAs()
 			if e != nil {
 				return e
 			}
@@ -184,6 +300,8 @@ func (m *Msg) UnMarshal(r *Reader) error {
 				Size:                       size,
 				DocumentSequenceIdentifier: ident,
 				DocumentSequences:          documents,
+				DocumentSequencesD:         documentsD,
+				DocumentSequencesRaw:       raws,
 			})
 		}
 	}
@@ -199,6 +317,24 @@ func (m *Msg) GetBodyMsgSection() bson.M {
 	return nil
 }
 
+func (m *Msg) GetBodyMsgSectionD() bson.D {
+	for _, v := range m.Sections {
+		if v.GetKind() == 0 {
+			return v.(*BodyMsgSection).BodyD
+		}
+	}
+	return nil
+}
+
+func (m *Msg) GetBodyMsgSectionRaw() bson.Raw {
+	for _, v := range m.Sections {
+		if v.GetKind() == 0 {
+			return v.(*BodyMsgSection).BodyRaw
+		}
+	}
+	return bson.Raw{}
+}
+
 type KillCursors struct {
 	// standard message header
 	Header MsgHeader
@@ -210,6 +346,23 @@ type KillCursors struct {
 	CursorIDs []int64
 }
 
+func (k *KillCursors) GetHeader() *MsgHeader {
+	return &k.Header
+}
+
+func (k *KillCursors) Write(w io.Writer) error {
+	k.Header.OpCode = OP_KILL_CURSORS
+	k.NumberOfCursorIDs = int32(len(k.CursorIDs))
+	buffer := &bytes.Buffer{}
+	data := []interface{}{k.ZERO, k.NumberOfCursorIDs, k.CursorIDs}
+	for _, v := range data {
+		if e := binary.Write(buffer, binary.LittleEndian, v); e != nil {
+			return e
+		}
+	}
+	return writeMessage(w, &k.Header, buffer.Bytes())
+}
+
 func (k *KillCursors) UnMarshal(r *Reader) error {
 	n, e := r.ReadInt32()
 	k.ZERO = n
@@ -233,15 +386,54 @@ func (k *KillCursors) UnMarshal(r *Reader) error {
 
 type Delete struct {
 	// standard message header
-	header MsgHeader
+	Header MsgHeader
 	// 0 - reserved for future use
 	ZERO int32
 	// "dbname.collectionname"
 	FullCollectionName string
-	// bit vector - see below for details.
-	Flags int32
+	// bit vector - see DeleteFlags
+	Flags DeleteFlags
 	// query object.  See below for details.
-	Selector bson.M
+	Selector    bson.M
+	SelectorD   bson.D
+	SelectorRaw bson.Raw
+}
+
+type DeleteFlags int32
+
+const (
+	// remove only the first matching document
+	SingleRemove DeleteFlags = 1 << 0
+)
+
+func (f DeleteFlags) Has(flag DeleteFlags) bool {
+	return f&flag != 0
+}
+
+func (f *DeleteFlags) Set(flag DeleteFlags) {
+	*f |= flag
+}
+
+func (f *DeleteFlags) Clear(flag DeleteFlags) {
+	*f &^= flag
+}
+
+func (d *Delete) GetHeader() *MsgHeader {
+	return &d.Header
+}
+
+func (d *Delete) Write(w io.Writer) error {
+	d.Header.OpCode = OP_DELETE
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, d.ZERO)
+	writeCString(buffer, d.FullCollectionName)
+	_ = binary.Write(buffer, binary.LittleEndian, d.Flags)
+	selector, e := marshalDocument(d.SelectorD, d.Selector, d.SelectorRaw)
+	if e != nil {
+		return e
+	}
+	buffer.Write(selector)
+	return writeMessage(w, &d.Header, buffer.Bytes())
 }
 
 func (d *Delete) UnMarshal(r *Reader) error {
@@ -250,9 +442,9 @@ func (d *Delete) UnMarshal(r *Reader) error {
 	s, e := r.ReadCString()
 	d.FullCollectionName = s
 	i, e := r.ReadInt32()
-	d.Flags = i
-	m, e := r.ReadDocument()
-	d.Selector = m
+	d.Flags = DeleteFlags(i)
+	m, md, raw, e := r.readDocumentAs()
+	d.Selector, d.SelectorD, d.SelectorRaw = m, md, raw
 	if e == io.EOF {
 		return nil
 	}
@@ -260,6 +452,8 @@ func (d *Delete) UnMarshal(r *Reader) error {
 }
 
 type GetMore struct {
+	// standard message header
+	Header MsgHeader
 	// 0 - reserved for future use
 	ZERO int32
 	// "dbname.collectionname"
@@ -270,6 +464,24 @@ type GetMore struct {
 	CursorID *int64
 }
 
+func (g *GetMore) GetHeader() *MsgHeader {
+	return &g.Header
+}
+
+func (g *GetMore) Write(w io.Writer) error {
+	g.Header.OpCode = OP_GET_MORE
+	var cursorID int64
+	if g.CursorID != nil {
+		cursorID = *g.CursorID
+	}
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, g.ZERO)
+	writeCString(buffer, g.FullCollectionName)
+	_ = binary.Write(buffer, binary.LittleEndian, g.NumberToReturn)
+	_ = binary.Write(buffer, binary.LittleEndian, cursorID)
+	return writeMessage(w, &g.Header, buffer.Bytes())
+}
+
 func (g *GetMore) UnMarshal(r *Reader) error {
 	n, e := r.ReadInt32()
 	g.ZERO = n
@@ -288,8 +500,8 @@ func (g *GetMore) UnMarshal(r *Reader) error {
 type Query struct {
 	// standard message header
 	Header MsgHeader
-	// bit vector of query options.  See below for details.
-	Flags int32
+	// bit vector of query options, see QueryFlags
+	Flags QueryFlags
 	// "dbname.collectionname"
 	FullCollectionName string
 	// number of documents to skip
@@ -298,25 +510,87 @@ type Query struct {
 	NumberToReturn int32
 	//  in the first OP_REPLY batch
 	// query object.  See below for details.
-	Query bson.M
+	Query    bson.M
+	QueryD   bson.D
+	QueryRaw bson.Raw
 	// Optional. Selector indicating the fields
-	ReturnFieldsSelector bson.M
+	ReturnFieldsSelector    bson.M
+	ReturnFieldsSelectorD   bson.D
+	ReturnFieldsSelectorRaw bson.Raw
 	//  to return.  See below for details.
 }
 
+type QueryFlags int32
+
+const (
+	// bit 0 is reserved
+	// the cursor is not closed when the last data is retrieved
+	TailableCursor QueryFlags = 1 << 1
+	// allow query of replica slave
+	SlaveOk QueryFlags = 1 << 2
+	// internal replication use only
+	OplogReplay QueryFlags = 1 << 3
+	// the server should not time out idle cursors
+	NoCursorTimeout QueryFlags = 1 << 4
+	// use with TailableCursor, block a while rather than returning no data
+	AwaitData QueryFlags = 1 << 5
+	// stream the data down full blast in multiple "more" packages
+	Exhaust QueryFlags = 1 << 6
+	// get partial results from a mongos if some shards are down
+	Partial QueryFlags = 1 << 7
+)
+
+func (f QueryFlags) Has(flag QueryFlags) bool {
+	return f&flag != 0
+}
+
+func (f *QueryFlags) Set(flag QueryFlags) {
+	*f |= flag
+}
+
+func (f *QueryFlags) Clear(flag QueryFlags) {
+	*f &^= flag
+}
+
+func (q *Query) GetHeader() *MsgHeader {
+	return &q.Header
+}
+
+func (q *Query) Write(w io.Writer) error {
+	q.Header.OpCode = OP_QUERY
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, q.Flags)
+	writeCString(buffer, q.FullCollectionName)
+	_ = binary.Write(buffer, binary.LittleEndian, q.NumberToSkip)
+	_ = binary.Write(buffer, binary.LittleEndian, q.NumberToReturn)
+	query, e := marshalDocument(q.QueryD, q.Query, q.QueryRaw)
+	if e != nil {
+		return e
+	}
+	buffer.Write(query)
+	if q.ReturnFieldsSelectorD != nil || q.ReturnFieldsSelector != nil || q.ReturnFieldsSelectorRaw.Data != nil {
+		selector, e := marshalDocument(q.ReturnFieldsSelectorD, q.ReturnFieldsSelector, q.ReturnFieldsSelectorRaw)
+		if e != nil {
+			return e
+		}
+		buffer.Write(selector)
+	}
+	return writeMessage(w, &q.Header, buffer.Bytes())
+}
+
 func (q *Query) UnMarshal(r *Reader) error {
 	n, e := r.ReadInt32()
-	q.Flags = n
+	q.Flags = QueryFlags(n)
 	s, e := r.ReadCString()
 	q.FullCollectionName = s
 	i, e := r.ReadInt32()
 	q.NumberToSkip = i
 	n2, e := r.ReadInt32()
 	q.NumberToReturn = n2
-	m, e := r.ReadDocument()
-	q.Query = m
-	ms, e := r.ReadDocument()
-	q.ReturnFieldsSelector = ms
+	m, md, raw, e := r.readCommandAs()
+	q.Query, q.QueryD, q.QueryRaw = m, md, raw
+	ms, msd, msRaw, e := r.readDocumentAs()
+	q.ReturnFieldsSelector, q.ReturnFieldsSelectorD, q.ReturnFieldsSelectorRaw = ms, msd, msRaw
 	if e == io.EOF {
 		return nil
 	}
@@ -326,21 +600,61 @@ func (q *Query) UnMarshal(r *Reader) error {
 type Insert struct {
 	// standard message header
 	Header MsgHeader
-	// bit vector - see below
-	Flags int32
+	// bit vector - see InsertFlags
+	Flags InsertFlags
 	// "dbname.collectionname"
 	FullCollectionName string
 	// one or more documents to insert into the collection
-	Documents []bson.M
+	Documents    []bson.M
+	DocumentsD   []bson.D
+	DocumentsRaw []bson.Raw
+}
+
+type InsertFlags int32
+
+const (
+	// continue inserting the remaining documents when one of them fails
+	ContinueOnError InsertFlags = 1 << 0
+)
+
+func (f InsertFlags) Has(flag InsertFlags) bool {
+	return f&flag != 0
+}
+
+func (f *InsertFlags) Set(flag InsertFlags) {
+	*f |= flag
+}
+
+func (f *InsertFlags) Clear(flag InsertFlags) {
+	*f &^= flag
+}
+
+func (i *Insert) GetHeader() *MsgHeader {
+	return &i.Header
+}
+
+func (i *Insert) Write(w io.Writer) error {
+	i.Header.OpCode = OP_INSERT
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, i.Flags)
+	writeCString(buffer, i.FullCollectionName)
+	for _, doc := range documentList(i.DocumentsD, i.Documents, i.DocumentsRaw) {
+		out, e := bson.Marshal(doc)
+		if e != nil {
+			return e
+		}
+		buffer.Write(out)
+	}
+	return writeMessage(w, &i.Header, buffer.Bytes())
 }
 
 func (i *Insert) UnMarshal(r *Reader) error {
 	n, e := r.ReadInt32()
-	i.Flags = n
+	i.Flags = InsertFlags(n)
 	s, e := r.ReadCString()
 	i.FullCollectionName = s
-	ms, e := r.ReadDocuments()
-	i.Documents = ms
+	ms, ds, raws, e := r.readDocumentsAs()
+	i.Documents, i.DocumentsD, i.DocumentsRaw = ms, ds, raws
 	if e == io.EOF {
 		return nil
 	}
@@ -354,12 +668,60 @@ type Update struct {
 	ZERO int32
 	// "dbname.collectionname"
 	FullCollectionName string
-	// bit vector. see below
-	Flags int32
+	// bit vector - see UpdateFlags
+	Flags UpdateFlags
 	// the query to select the document
-	Selector bson.M
+	Selector    bson.M
+	SelectorD   bson.D
+	SelectorRaw bson.Raw
 	// specification of the update to perform
-	Update bson.M
+	Update    bson.M
+	UpdateD   bson.D
+	UpdateRaw bson.Raw
+}
+
+type UpdateFlags int32
+
+const (
+	// insert the supplied object if no matching document is found
+	Upsert UpdateFlags = 1 << 0
+	// update all matching documents instead of only the first one
+	MultiUpdate UpdateFlags = 1 << 1
+)
+
+func (f UpdateFlags) Has(flag UpdateFlags) bool {
+	return f&flag != 0
+}
+
+func (f *UpdateFlags) Set(flag UpdateFlags) {
+	*f |= flag
+}
+
+func (f *UpdateFlags) Clear(flag UpdateFlags) {
+	*f &^= flag
+}
+
+func (u *Update) GetHeader() *MsgHeader {
+	return &u.Header
+}
+
+func (u *Update) Write(w io.Writer) error {
+	u.Header.OpCode = OP_UPDATE
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, u.ZERO)
+	writeCString(buffer, u.FullCollectionName)
+	_ = binary.Write(buffer, binary.LittleEndian, u.Flags)
+	selector, e := marshalDocument(u.SelectorD, u.Selector, u.SelectorRaw)
+	if e != nil {
+		return e
+	}
+	buffer.Write(selector)
+	update, e := marshalDocument(u.UpdateD, u.Update, u.UpdateRaw)
+	if e != nil {
+		return e
+	}
+	buffer.Write(update)
+	return writeMessage(w, &u.Header, buffer.Bytes())
 }
 
 func (u *Update) UnMarshal(r *Reader) error {
@@ -368,17 +730,73 @@ func (u *Update) UnMarshal(r *Reader) error {
 	s, e := r.ReadCString()
 	u.FullCollectionName = s
 	n, e := r.ReadInt32()
-	u.Flags = n
-	m, e := r.ReadDocument()
-	u.Selector = m
-	ms, e := r.ReadDocument()
-	u.Update = ms
+	u.Flags = UpdateFlags(n)
+	m, md, raw, e := r.readDocumentAs()
+	u.Selector, u.SelectorD, u.SelectorRaw = m, md, raw
+	ms, msd, msRaw, e := r.readDocumentAs()
+	u.Update, u.UpdateD, u.UpdateRaw = ms, msd, msRaw
 	if e == io.EOF {
 		return nil
 	}
 	return e
 }
 
+/*
+写出时使用的文档,优先级为 bson.D > bson.M > bson.Raw
+*/
+func marshalDocument(d bson.D, m bson.M, raw bson.Raw) ([]byte, error) {
+	switch {
+	case d != nil:
+		return bson.Marshal(d)
+	case m != nil:
+		return bson.Marshal(m)
+	case raw.Data != nil:
+		return raw.Data, nil
+	}
+	return bson.Marshal(bson.M{})
+}
+
+/*
+文档列表,优先级同marshalDocument
+*/
+func documentList(ds []bson.D, ms []bson.M, raws []bson.Raw) []interface{} {
+	docs := make([]interface{}, 0)
+	switch {
+	case ds != nil:
+		for _, v := range ds {
+			docs = append(docs, v)
+		}
+	case ms != nil:
+		for _, v := range ms {
+			docs = append(docs, v)
+		}
+	default:
+		for _, v := range raws {
+			docs = append(docs, v)
+		}
+	}
+	return docs
+}
+
+func writeCString(buffer *bytes.Buffer, s string) {
+	buffer.WriteString(s)
+	buffer.WriteByte(CStringEndByte)
+}
+
+/*
+计算messageLength,并将header与body一次性写入w
+*/
+func writeMessage(w io.Writer, header *MsgHeader, body []byte) error {
+	header.MessageLength = int32(4*4 + len(body))
+	buffer := bytes.NewBuffer(make([]byte, 0, int(header.MessageLength)))
+	if e := binary.Write(buffer, binary.LittleEndian, header); e != nil {
+		return e
+	}
+	buffer.Write(body)
+	_, e := w.Write(buffer.Bytes())
+	return e
+}
+
 type UnMarshaler interface {
 	UnMarshal(r *Reader) error
 }
@@ -403,10 +821,10 @@ type Reply struct {
 	CursorID int64
 	// where in the cursor this reply is starting
 	StartingFrom int32
-	// number of documents in the reply
+	// number of documents in the reply, derived from Documents when writing
 	NumberReturned int32
-	// documents
-	Documents interface{}
+	// documents, each one is bson.M, bson.D, bson.Raw or any marshalable value
+	Documents []interface{}
 }
 
 func NewReply(requestId int32) *Reply {
@@ -420,40 +838,99 @@ func NewReply(requestId int32) *Reply {
 	}
 }
 
-/*
-1,计算header中字节大小
-2,依次按照小端序写入w
-*/
-func (r *Reply) Write(w io.Writer) error {
-	out, e := bson.Marshal(r.Documents)
+func (r *Reply) UnMarshal(reader *Reader) error {
+	if reader.Header != nil {
+		r.Header = reader.Header
+	}
+	flags, e := reader.ReadInt32()
 	if e != nil {
 		return e
 	}
-	dataLen := 4*4 + 4 + 8 + 4 + 4 + len(out)
-	r.Header.MessageLength = int32(dataLen)
-	data := []interface{}{r.Header, r.ResponseFlags, r.CursorID, r.StartingFrom, r.NumberReturned}
-	for _, v := range data {
-		e = binary.Write(w, binary.LittleEndian, v)
-		if e != nil {
-			return e
-		}
+	r.ResponseFlags = ResponseFlags(flags)
+	cursorID, e := reader.ReadInt64()
+	if e != nil {
+		return e
+	}
+	r.CursorID = *cursorID
+	if r.StartingFrom, e = reader.ReadInt32(); e != nil {
+		return e
+	}
+	if r.NumberReturned, e = reader.ReadInt32(); e != nil {
+		return e
 	}
-	_, e = w.Write(out)
+	ms, ds, raws, e := reader.readDocumentsLimit(reader.maxCommandSize())
 	if e != nil {
 		return e
 	}
+	r.Documents = make([]interface{}, 0, len(raws))
+	for i := range raws {
+		switch reader.Mode {
+		case DocumentOrdered:
+			r.Documents = append(r.Documents, ds[i])
+		case DocumentMap:
+			r.Documents = append(r.Documents, ms[i])
+		default:
+			r.Documents = append(r.Documents, raws[i])
+		}
+	}
+	if int(r.NumberReturned) != len(r.Documents) {
+		return fmt.Errorf("numberReturned is %d but reply contains %d documents", r.NumberReturned, len(r.Documents))
+	}
 	return nil
 }
 
+func (r *Reply) AddDocument(doc interface{}) {
+	r.Documents = append(r.Documents, doc)
+}
+
+/*
+1,按照小端序写入字段并依次序列化每个文档,计算header中字节大小
+2,组装完整的消息后一次写入w,避免与同一连接上其他goroutine的写入交错
+*/
+func (r *Reply) Write(w io.Writer) error {
+	buffer := &bytes.Buffer{}
+	r.NumberReturned = int32(len(r.Documents))
+	data := []interface{}{r.ResponseFlags, r.CursorID, r.StartingFrom, r.NumberReturned}
+	for _, v := range data {
+		if e := binary.Write(buffer, binary.LittleEndian, v); e != nil {
+			return e
+		}
+	}
+	for _, doc := range r.Documents {
+		out, e := bson.Marshal(doc)
+		if e != nil {
+			return e
+		}
+		buffer.Write(out)
+	}
+	return writeMessage(w, r.Header, buffer.Bytes())
+}
+
 type ResponseFlags int32
 
 const (
-	CursorNotFound ResponseFlags = iota
+	// getMore was called with a cursor id unknown to the server
+	CursorNotFound ResponseFlags = 1 << iota
+	// the query failed, the reply contains one document with an $err field
 	QueryFailure
+	// drivers should ignore this, only mongos will ever see it set
 	ShardConfigStale
+	// the server supports the AwaitData query option
 	AwaitCapable
 )
 
+func (f ResponseFlags) Has(flag ResponseFlags) bool {
+	return f&flag != 0
+}
+
+func (f *ResponseFlags) Set(flag ResponseFlags) {
+	*f |= flag
+}
+
+func (f *ResponseFlags) Clear(flag ResponseFlags) {
+	*f &^= flag
+}
+
 type OpCode int32
 
 const (
@@ -465,5 +942,6 @@ const (
 	OP_GET_MORE     OpCode = 2005
 	OP_DELETE       OpCode = 2006
 	OP_KILL_CURSORS OpCode = 2007
+	OP_COMPRESSED   OpCode = 2012
 	OP_MSG          OpCode = 2013
 )
@@ -0,0 +1,280 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func writeChecksumMsg(t *testing.T) []byte {
+	reply := NewMsgReply(3)
+	reply.FlatBits = ChecksumPresent
+	section := NewBodyMsgSection()
+	section.Body = bson.M{"ping": 1}
+	reply.Sections = append(reply.Sections, section)
+	buffer := &bytes.Buffer{}
+	if e := reply.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	return buffer.Bytes()
+}
+
+func TestMsgChecksum(t *testing.T) {
+	frame := writeChecksumMsg(t)
+	header, body, e := readMessage(bytes.NewReader(frame))
+	if e != nil {
+		t.Fatal(e)
+	}
+	msg := &Msg{}
+	if e := msg.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	if len(msg.Sections) != 1 || msg.GetBodyMsgSection()["ping"] != 1 {
+		t.Fatalf("unexpected sections %v", msg.Sections)
+	}
+}
+
+func TestMsgChecksumMismatch(t *testing.T) {
+	frame := writeChecksumMsg(t)
+	// 篡改body中的一个字节
+	frame[len(frame)-6] ^= 0xff
+	header, body, e := readMessage(bytes.NewReader(frame))
+	if e != nil {
+		t.Fatal(e)
+	}
+	msg := &Msg{}
+	e = msg.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header})
+	if _, ok := e.(*ChecksumError); !ok {
+		t.Fatalf("expected ChecksumError, got %v", e)
+	}
+}
+
+func TestDocumentSequenceRoundTrip(t *testing.T) {
+	reply := NewMsgReply(5)
+	body := NewBodyMsgSection()
+	body.Body = bson.M{"insert": "users", "$db": "test"}
+	sequence := NewDocumentSequenceMsgSection()
+	sequence.DocumentSequenceIdentifier = "documents"
+	sequence.DocumentSequences = []bson.M{{"_id": 1}, {"_id": 2}}
+	updates := NewDocumentSequenceMsgSection()
+	updates.DocumentSequenceIdentifier = "updates"
+	updates.DocumentSequences = []bson.M{{"q": bson.M{"_id": 1}, "u": bson.M{"$set": bson.M{"a": 1}}}}
+	reply.Sections = append(reply.Sections, body, sequence, updates)
+	buffer := &bytes.Buffer{}
+	if e := reply.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+
+	header, data, e := readMessage(buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	msg := &Msg{}
+	if e := msg.UnMarshal(&Reader{Reader: bytes.NewReader(data), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	if len(msg.Sections) != 3 {
+		t.Fatalf("expected 3 sections, got %d", len(msg.Sections))
+	}
+	documents := msg.Sections[1].(*DocumentSequenceMsgSection)
+	if documents.DocumentSequenceIdentifier != "documents" || len(documents.DocumentSequences) != 2 || documents.Size != sequence.Size {
+		t.Fatalf("unexpected section %+v", documents)
+	}
+	if documents.DocumentSequences[1]["_id"] != 2 {
+		t.Fatalf("unexpected documents %v", documents.DocumentSequences)
+	}
+	if msg.Sections[2].(*DocumentSequenceMsgSection).DocumentSequenceIdentifier != "updates" {
+		t.Fatalf("unexpected section %+v", msg.Sections[2])
+	}
+}
+
+func TestOrderedDocuments(t *testing.T) {
+	reply := NewMsgReply(1)
+	body := NewBodyMsgSection()
+	body.BodyD = bson.D{
+		{Name: "find", Value: "users"},
+		{Name: "sort", Value: bson.D{{Name: "b", Value: -1}, {Name: "a", Value: 1}}},
+		{Name: "$db", Value: "test"},
+	}
+	sequence := NewDocumentSequenceMsgSection()
+	sequence.DocumentSequenceIdentifier = "documents"
+	sequence.DocumentSequencesD = []bson.D{{{Name: "z", Value: 1}, {Name: "a", Value: 2}}}
+	reply.Sections = append(reply.Sections, body, sequence)
+	buffer := &bytes.Buffer{}
+	if e := reply.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, data, e := readMessage(buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	msg := &Msg{}
+	if e := msg.UnMarshal(&Reader{Reader: bytes.NewReader(data), Header: header, Mode: DocumentOrdered}); e != nil {
+		t.Fatal(e)
+	}
+	d := msg.GetBodyMsgSectionD()
+	if msg.GetBodyMsgSection() != nil || len(d) != 3 || d[0].Name != "find" || d[2].Name != "$db" {
+		t.Fatalf("unexpected body %v", d)
+	}
+	sort, ok := d[1].Value.(bson.D)
+	if !ok || sort[0].Name != "b" || sort[1].Name != "a" {
+		t.Fatalf("unexpected sort %#v", d[1].Value)
+	}
+	documents := msg.Sections[1].(*DocumentSequenceMsgSection).DocumentSequencesD
+	if len(documents) != 1 || documents[0][0].Name != "z" {
+		t.Fatalf("unexpected documents %v", documents)
+	}
+
+	raw := &Msg{}
+	if e := raw.UnMarshal(&Reader{Reader: bytes.NewReader(data), Header: header, Mode: DocumentRaw}); e != nil {
+		t.Fatal(e)
+	}
+	if raw.GetBodyMsgSection() != nil || raw.GetBodyMsgSectionD() != nil {
+		t.Fatalf("raw mode should not decode documents")
+	}
+	rawBody := raw.GetBodyMsgSectionRaw()
+	var decoded bson.D
+	if e := rawBody.Unmarshal(&decoded); e != nil || decoded[0].Name != "find" {
+		t.Fatalf("unexpected raw body %v %v", decoded, e)
+	}
+
+	// raw文档原样写出
+	echo := NewMsgReply(2)
+	echo.Sections = raw.Sections
+	out := &bytes.Buffer{}
+	if e := echo.Write(out); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(out.Bytes()[4*4:], data) {
+		t.Fatalf("raw sections were not written verbatim")
+	}
+}
+
+func readTestMessage(t *testing.T, w Writer, out UnMarshaler, opCode OpCode) *MsgHeader {
+	buffer := &bytes.Buffer{}
+	if e := w.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, body, e := readMessage(buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if header.OpCode != opCode {
+		t.Fatalf("expected %v, got %v", opCode, header.OpCode)
+	}
+	if e := out.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	return header
+}
+
+func TestRequestWriteRoundTrip(t *testing.T) {
+	query := &Query{Flags: SlaveOk, FullCollectionName: "test.users", NumberToSkip: 1, NumberToReturn: 10,
+		Query: bson.M{"a": 1}, ReturnFieldsSelector: bson.M{"b": 1}}
+	query.Header.RequestID = 9
+	decodedQuery := &Query{}
+	header := readTestMessage(t, query, decodedQuery, OP_QUERY)
+	if header.RequestID != 9 || !decodedQuery.Flags.Has(SlaveOk) || decodedQuery.NumberToReturn != 10 ||
+		decodedQuery.Query["a"] != 1 || decodedQuery.ReturnFieldsSelector["b"] != 1 {
+		t.Fatalf("unexpected query %+v", decodedQuery)
+	}
+
+	insert := &Insert{Flags: ContinueOnError, FullCollectionName: "test.users", Documents: []bson.M{{"_id": 1}, {"_id": 2}}}
+	decodedInsert := &Insert{}
+	readTestMessage(t, insert, decodedInsert, OP_INSERT)
+	if !decodedInsert.Flags.Has(ContinueOnError) || len(decodedInsert.Documents) != 2 {
+		t.Fatalf("unexpected insert %+v", decodedInsert)
+	}
+
+	update := &Update{FullCollectionName: "test.users", Flags: Upsert, Selector: bson.M{"_id": 1}, Update: bson.M{"a": 2}}
+	decodedUpdate := &Update{}
+	readTestMessage(t, update, decodedUpdate, OP_UPDATE)
+	if !decodedUpdate.Flags.Has(Upsert) || decodedUpdate.Selector["_id"] != 1 || decodedUpdate.Update["a"] != 2 {
+		t.Fatalf("unexpected update %+v", decodedUpdate)
+	}
+
+	del := &Delete{FullCollectionName: "test.users", Flags: SingleRemove, Selector: bson.M{"_id": 1}}
+	decodedDelete := &Delete{}
+	readTestMessage(t, del, decodedDelete, OP_DELETE)
+	if !decodedDelete.Flags.Has(SingleRemove) || decodedDelete.Selector["_id"] != 1 {
+		t.Fatalf("unexpected delete %+v", decodedDelete)
+	}
+
+	cursorID := int64(12345)
+	getMore := &GetMore{FullCollectionName: "test.users", NumberToReturn: 5, CursorID: &cursorID}
+	decodedGetMore := &GetMore{}
+	readTestMessage(t, getMore, decodedGetMore, OP_GET_MORE)
+	if decodedGetMore.NumberToReturn != 5 || *decodedGetMore.CursorID != cursorID {
+		t.Fatalf("unexpected getMore %+v", decodedGetMore)
+	}
+
+	kill := &KillCursors{CursorIDs: []int64{1, 2, 3}}
+	decodedKill := &KillCursors{}
+	readTestMessage(t, kill, decodedKill, OP_KILL_CURSORS)
+	if decodedKill.NumberOfCursorIDs != 3 || len(decodedKill.CursorIDs) != 3 || decodedKill.CursorIDs[2] != 3 {
+		t.Fatalf("unexpected killCursors %+v", decodedKill)
+	}
+
+	msg := &Msg{Header: &MsgHeader{RequestID: 11}, FlatBits: ChecksumPresent}
+	body := NewBodyMsgSection()
+	body.Body = bson.M{"ping": 1}
+	msg.Sections = append(msg.Sections, body)
+	decodedMsg := &Msg{}
+	header = readTestMessage(t, msg, decodedMsg, OP_MSG)
+	if header.RequestID != 11 || decodedMsg.Header != header || decodedMsg.GetBodyMsgSection()["ping"] != 1 {
+		t.Fatalf("unexpected msg %+v", decodedMsg)
+	}
+}
+
+func TestDecodeReplies(t *testing.T) {
+	reply := NewReply(5)
+	reply.CursorID = 77
+	reply.ResponseFlags.Set(AwaitCapable)
+	for i := 0; i < 3; i++ {
+		reply.AddDocument(bson.D{{Name: "_id", Value: i}, {Name: "a", Value: i}})
+	}
+	buffer := &bytes.Buffer{}
+	if e := reply.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	header, message, e := DecodeMessage(buffer, DocumentOrdered)
+	if e != nil {
+		t.Fatal(e)
+	}
+	decoded := message.(*Reply)
+	if header.ResponseTo != 5 || decoded.CursorID != 77 || !decoded.ResponseFlags.Has(AwaitCapable) || decoded.NumberReturned != 3 {
+		t.Fatalf("unexpected reply %+v", decoded)
+	}
+	if doc := decoded.Documents[2].(bson.D); doc[0].Name != "_id" || doc[1].Value != 2 {
+		t.Fatalf("unexpected document %v", doc)
+	}
+
+	msgReply := NewMsgReply(6)
+	body := NewBodyMsgSection()
+	body.Body = bson.M{"ok": 1}
+	sequence := NewDocumentSequenceMsgSection()
+	sequence.DocumentSequenceIdentifier = "cursor.firstBatch"
+	sequence.DocumentSequences = []bson.M{{"_id": 1}, {"_id": 2}}
+	msgReply.Sections = append(msgReply.Sections, body, sequence)
+	buffer.Reset()
+	if e := msgReply.Write(buffer); e != nil {
+		t.Fatal(e)
+	}
+	frame, e := compressFrame(buffer.Bytes(), compressors[CompressorSnappy])
+	if e != nil {
+		t.Fatal(e)
+	}
+	header, message, e = DecodeMessage(bytes.NewReader(frame), DocumentMap)
+	if e != nil {
+		t.Fatal(e)
+	}
+	decodedMsg := message.(*MsgReply)
+	if header.OpCode != OP_MSG || decodedMsg.Header.ResponseTo != 6 || len(decodedMsg.Sections) != 2 {
+		t.Fatalf("unexpected msg reply %+v", decodedMsg)
+	}
+	documents := decodedMsg.Sections[1].(*DocumentSequenceMsgSection)
+	if documents.DocumentSequenceIdentifier != "cursor.firstBatch" || len(documents.DocumentSequences) != 2 {
+		t.Fatalf("unexpected section %+v", documents)
+	}
+}
@@ -0,0 +1,242 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net"
+)
+
+const proxyUpstreamKey = "proxy.upstream"
+
+/*
+请求或回复的钩子,body不含header,可以使用ParseMessage/EncodeMessage解码与重新编码;
+返回新的body(header中的messageLength会重新计算),返回错误时请求不会被转发.
+需要修改文档时应使用DocumentOrdered或DocumentRaw解码,DocumentMap重新编码后key的顺序会丢失,
+命令名称可能不再是第一个key;没有修改时应原样返回body
+*/
+type ProxyHook func(conn *ConnContext, header *MsgHeader, body []byte) ([]byte, error)
+
+/*
+透明代理,每个客户端连接对应一个上游连接,请求与回复按原样转发,
+可通过SetDefaultHandler挂载到Server上
+*/
+type ProxyHandler struct {
+	// 建立到上游的连接
+	Dial func() (net.Conn, error)
+	// 转发请求前调用
+	OnRequest ProxyHook
+	// 回复客户端前调用
+	OnResponse ProxyHook
+	// 前端Server,握手回复中的compression按它启用的压缩器重新协商;为nil时从握手回复中去掉compression
+	Server *Server
+}
+
+func NewProxyHandler(addr string) *ProxyHandler {
+	return &ProxyHandler{
+		Dial: func() (net.Conn, error) {
+			return net.Dial(`tcp`, addr)
+		},
+	}
+}
+
+func (p *ProxyHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	body, e := ioutil.ReadAll(r)
+	if e != nil {
+		return e
+	}
+	if p.OnRequest != nil {
+		if body, e = p.OnRequest(conn, header, body); e != nil {
+			return e
+		}
+	}
+	upstream, e := p.upstream(conn)
+	if e != nil {
+		return e
+	}
+	request := *header
+	if e := writeMessage(upstream, &request, body); e != nil {
+		p.closeUpstream(conn)
+		return e
+	}
+	if !expectReply(header.OpCode, body) {
+		return nil
+	}
+	handshake := isHandshakeRequest(header, body)
+	for {
+		replyHeader, replyBody, e := readMessage(upstream)
+		if e != nil {
+			p.closeUpstream(conn)
+			return e
+		}
+		if replyHeader.OpCode == OP_COMPRESSED {
+			if replyHeader, replyBody, _, e = decompressMessage(replyHeader, replyBody); e != nil {
+				p.closeUpstream(conn)
+				return e
+			}
+		}
+		if handshake {
+			if replyHeader, replyBody, e = p.negotiateCompression(conn, replyHeader, replyBody); e != nil {
+				return e
+			}
+		}
+		if p.OnResponse != nil {
+			if replyBody, e = p.OnResponse(conn, replyHeader, replyBody); e != nil {
+				return e
+			}
+		}
+		if e := writeMessage(conn, replyHeader, replyBody); e != nil {
+			return e
+		}
+		//exhaust: 上游设置了moreToCome时继续转发后续回复
+		if replyHeader.OpCode != OP_MSG || !hasMoreToCome(replyBody) {
+			return nil
+		}
+	}
+}
+
+var handshakeCommands = map[string]bool{"hello": true, "isMaster": true, "ismaster": true}
+
+/*
+请求是否为hello/isMaster,OP_MSG只读取body section的第一个key
+*/
+func isHandshakeRequest(header *MsgHeader, body []byte) bool {
+	switch header.OpCode {
+	case OP_MSG:
+		for i := 4; i+5 < len(body); {
+			kind, size := body[i], int(int32(binary.LittleEndian.Uint32(body[i+1:])))
+			if kind == 0 {
+				return handshakeCommands[firstKey(body[i+1:])]
+			}
+			if size < 4 {
+				return false
+			}
+			i += 1 + size
+		}
+	case OP_QUERY:
+		message, e := ParseMessage(header, body, DocumentOrdered)
+		if e != nil {
+			return false
+		}
+		query := message.(*Query)
+		if _, collection := splitNamespace(query.FullCollectionName); collection != "$cmd" {
+			return false
+		}
+		doc, _ := unwrapLegacyQuery(query.QueryD)
+		return len(doc) > 0 && handshakeCommands[doc[0].Name]
+	}
+	return false
+}
+
+/*
+bson文档第一个元素的名称
+*/
+func firstKey(doc []byte) string {
+	if len(doc) < 6 || doc[4] == 0 {
+		return ""
+	}
+	end := bytes.IndexByte(doc[5:], CStringEndByte)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
+}
+
+/*
+上游握手回复中的compression是上游与客户端协商的结果,客户端的压缩请求由前端Server解压,
+因此按前端Server启用的压缩器重新协商,并记录到客户端连接上
+*/
+func (p *ProxyHandler) negotiateCompression(conn *ConnContext, header *MsgHeader, body []byte) (*MsgHeader, []byte, error) {
+	message, e := ParseMessage(header, body, DocumentOrdered)
+	if e != nil {
+		return nil, nil, e
+	}
+	var doc bson.D
+	var setDoc func(bson.D)
+	switch m := message.(type) {
+	case *MsgReply:
+		for _, v := range m.Sections {
+			if section, ok := v.(*BodyMsgSection); ok {
+				doc, setDoc = section.BodyD, func(d bson.D) { section.BodyD = d }
+				break
+			}
+		}
+	case *Reply:
+		if len(m.Documents) > 0 {
+			doc, _ = m.Documents[0].(bson.D)
+			setDoc = func(d bson.D) { m.Documents[0] = d }
+		}
+	}
+	index := -1
+	requested := make([]string, 0)
+	for i, elem := range doc {
+		if elem.Name == "compression" {
+			index = i
+			list, _ := elem.Value.([]interface{})
+			for _, v := range list {
+				if name, ok := v.(string); ok {
+					requested = append(requested, name)
+				}
+			}
+		}
+	}
+	if index < 0 {
+		return header, body, nil
+	}
+	var compression []string
+	if p.Server != nil {
+		compression = p.Server.NegotiateCompression(requested)
+	}
+	reply := append(bson.D{}, doc[:index]...)
+	if len(compression) > 0 {
+		conn.SetCompression(compression)
+		reply = append(reply, bson.DocElem{Name: "compression", Value: compression})
+	}
+	setDoc(append(reply, doc[index+1:]...))
+	return EncodeMessage(message.(Writer))
+}
+
+/*
+OP_INSERT等旧版写操作与设置了moreToCome的OP_MSG没有回复
+*/
+func expectReply(opCode OpCode, body []byte) bool {
+	switch opCode {
+	case OP_QUERY, OP_GET_MORE:
+		return true
+	case OP_MSG:
+		return !hasMoreToCome(body)
+	}
+	return false
+}
+
+func hasMoreToCome(body []byte) bool {
+	return len(body) >= 4 && MsgFlags(binary.LittleEndian.Uint32(body)).Has(MoreToCome)
+}
+
+func (p *ProxyHandler) upstream(conn *ConnContext) (net.Conn, error) {
+	if v, ok := conn.Get(proxyUpstreamKey); ok {
+		return v.(net.Conn), nil
+	}
+	upstream, e := p.Dial()
+	if e != nil {
+		return nil, e
+	}
+	conn.Set(proxyUpstreamKey, upstream)
+	conn.OnClose(func() {
+		p.closeUpstream(conn)
+	})
+	return upstream, nil
+}
+
+func (p *ProxyHandler) closeUpstream(conn *ConnContext) {
+	v, ok := conn.Get(proxyUpstreamKey)
+	if !ok {
+		return
+	}
+	conn.Delete(proxyUpstreamKey)
+	if e := v.(net.Conn).Close(); e != nil {
+		logrus.Debugf("[proxy]close upstream error:%v", e)
+	}
+}
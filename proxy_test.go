@@ -0,0 +1,197 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler(t *testing.T) {
+	upstream := NewServer(`0`)
+	router := NewCommandRouter()
+	NewHandshake(upstream).Register(router)
+	router.Handle("echo", func(cmd *Command) (interface{}, error) {
+		return bson.M{"ok": 1, "value": cmd.Value(), "comment": cmd.Map()["comment"]}, nil
+	})
+	upstream.AddHandler(OP_MSG, router)
+	upstream.AddHandler(OP_QUERY, router)
+
+	proxy := &ProxyHandler{
+		Dial: func() (net.Conn, error) {
+			client, conn := net.Pipe()
+			go upstream.handler(context.TODO(), conn)
+			return client, nil
+		},
+		OnRequest: func(conn *ConnContext, header *MsgHeader, body []byte) ([]byte, error) {
+			if header.OpCode != OP_MSG {
+				return body, nil
+			}
+			message, e := ParseMessage(header, body, DocumentOrdered)
+			if e != nil {
+				return nil, e
+			}
+			msg := message.(*Msg)
+			switch msg.GetBodyMsgSectionD()[0].Name {
+			case "dropDatabase":
+				return nil, NewCommandError(CodeUnauthorized, "dropDatabase is not allowed")
+			case "echo":
+				//bson.D保留key的顺序,命令名称仍然是第一个key
+				section := msg.Sections[0].(*BodyMsgSection)
+				section.BodyD = append(section.BodyD, bson.DocElem{Name: "comment", Value: "proxy"})
+				_, body, e = EncodeMessage(msg)
+			}
+			return body, e
+		},
+		OnResponse: func(conn *ConnContext, header *MsgHeader, body []byte) ([]byte, error) {
+			if header.OpCode != OP_MSG {
+				return body, nil
+			}
+			message, e := ParseMessage(header, body, DocumentOrdered)
+			if e != nil {
+				return nil, e
+			}
+			reply := message.(*MsgReply)
+			section := reply.Sections[0].(*BodyMsgSection)
+			if _, ok := section.BodyD.Map()["value"]; !ok {
+				return body, nil
+			}
+			section.BodyD = append(section.BodyD, bson.DocElem{Name: "proxied", Value: true})
+			_, body, e = EncodeMessage(reply)
+			return body, e
+		},
+	}
+	front := NewServer(`0`)
+	front.SetDefaultHandler(proxy)
+	client := newTestClient(front)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, e := client.RunCommand(ctx, "test", bson.D{{Name: "echo", Value: "hi"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result["value"] != "hi" || result["comment"] != "proxy" || result["proxied"] != true {
+		t.Fatalf("unexpected result %v", result)
+	}
+
+	_, e = client.RunCommand(ctx, "test", bson.D{{Name: "dropDatabase", Value: 1}})
+	if ce, ok := e.(*CommandError); !ok || ce.Code != CodeUnauthorized {
+		t.Fatalf("expected Unauthorized, got %v", e)
+	}
+
+	query := &Query{FullCollectionName: "admin.$cmd", NumberToReturn: -1, QueryD: bson.D{{Name: "isMaster", Value: 1}}}
+	reply, e := client.SendQuery(ctx, query)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply.Documents[0].(bson.M)["ismaster"] != true {
+		t.Fatalf("unexpected reply %v", reply.Documents)
+	}
+}
+
+func TestProxyCompression(t *testing.T) {
+	upstream := NewServer(`0`)
+	_ = upstream.SetCompressors("snappy", "zstd")
+	router := NewCommandRouter()
+	NewHandshake(upstream).Register(router)
+	upstream.AddHandler(OP_MSG, router)
+	proxy := &ProxyHandler{
+		Dial: func() (net.Conn, error) {
+			client, conn := net.Pipe()
+			go upstream.handler(context.TODO(), conn)
+			return client, nil
+		},
+	}
+	front := NewServer(`0`)
+	_ = front.SetCompressors("snappy", "zlib")
+	front.SetDefaultHandler(proxy)
+	hello := bson.D{{Name: "hello", Value: 1}, {Name: "compression", Value: []string{"zstd", "snappy", "zlib"}}, {Name: "$db", Value: "admin"}}
+
+	//没有设置Server时不协商压缩
+	client := newHandshakeTestConn(front)
+	defer client.Close()
+	sendTestMsg(t, client, 1, 0, hello)
+	_, msg := readTestMsg(t, client)
+	if body := msg.GetBodyMsgSection(); !isOk(body["ok"]) || body["compression"] != nil {
+		t.Fatalf("unexpected hello %v", body)
+	}
+
+	proxy.Server = front
+	client = newHandshakeTestConn(front)
+	defer client.Close()
+	sendTestMsg(t, client, 1, 0, hello)
+	_, msg = readTestMsg(t, client)
+	compression, _ := msg.GetBodyMsgSection()["compression"].([]interface{})
+	if len(compression) != 1 || compression[0] != "snappy" {
+		t.Fatalf("unexpected compression %v", msg.GetBodyMsgSection())
+	}
+	sendCompressedTestMsg(t, client, 2, compressors[CompressorSnappy], bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	header, body, e := readMessage(client)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if header.OpCode == OP_COMPRESSED {
+		if header, body, _, e = decompressMessage(header, body); e != nil {
+			t.Fatal(e)
+		}
+	}
+	reply := &Msg{}
+	if e := reply.UnMarshal(&Reader{Reader: bytes.NewReader(body)}); e != nil {
+		t.Fatal(e)
+	}
+	if header.ResponseTo != 2 || !isOk(reply.GetBodyMsgSection()["ok"]) {
+		t.Fatalf("unexpected ping reply %v", reply.GetBodyMsgSection())
+	}
+	//上游支持zstd,但前端Server没有启用
+	sendCompressedTestMsg(t, client, 3, compressors[CompressorZstd], bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, client)
+	if msg.GetBodyMsgSection()["code"] != int(CodeProtocolError) {
+		t.Fatalf("unexpected reply %v", msg.GetBodyMsgSection())
+	}
+}
+
+/*
+上游回复无法解压时关闭上游连接,下一个请求重新建立连接
+*/
+func TestProxyCorruptUpstreamReply(t *testing.T) {
+	var dials int32
+	proxy := &ProxyHandler{
+		Dial: func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			client, conn := net.Pipe()
+			go func() {
+				defer conn.Close()
+				for {
+					header, _, e := readMessage(conn)
+					if e != nil {
+						return
+					}
+					//未知的compressorId,后面还有未读的数据
+					body := []byte{0xdd, 0x07, 0, 0, 100, 0, 0, 0, 99, 1, 2, 3}
+					if e := writeMessage(conn, &MsgHeader{RequestID: 1, ResponseTo: header.RequestID, OpCode: OP_COMPRESSED}, body); e != nil {
+						return
+					}
+				}
+			}()
+			return client, nil
+		},
+	}
+	front := NewServer(`0`)
+	front.SetDefaultHandler(proxy)
+	client := newHandshakeTestConn(front)
+	defer client.Close()
+	for i := int32(1); i <= 2; i++ {
+		sendTestMsg(t, client, i, 0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+		if _, msg := readTestMsg(t, client); isOk(msg.GetBodyMsgSection()["ok"]) {
+			t.Fatalf("expected error reply, got %v", msg.GetBodyMsgSection())
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("expected upstream to be redialed, got %d dials", n)
+	}
+}
@@ -1,15 +1,76 @@
 package mongo_protocol
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 )
 
 type Reader struct {
 	io.Reader
+	// header of the message being read, used to verify OP_MSG checksums
+	Header *MsgHeader
+	// representation of decoded documents, see DocumentMode
+	Mode DocumentMode
+	// maximum size of a single document, 0 means DefaultMaxBsonObjectSize;
+	// command objects (OP_MSG body, OP_QUERY query, OP_REPLY documents) may exceed it by bsonObjectSizeSlack
+	MaxDocumentSize int32
 }
 
+const (
+	// 与mongod一致的默认限制,握手时通过maxBsonObjectSize与maxMessageSizeBytes告知客户端
+	DefaultMaxBsonObjectSize   = 16 * 1024 * 1024
+	DefaultMaxMessageSizeBytes = 48000000
+	// mongod允许命令文档比maxBsonObjectSize多出16KB,用于存放命令本身的字段
+	bsonObjectSizeSlack = 16 * 1024
+	minDocumentSize     = 5
+)
+
+/*
+消息或文档的长度小于最小长度或超过限制
+*/
+type SizeError struct {
+	// "message" 或 "document"
+	Kind string
+	Size int64
+	Min  int64
+	Max  int64
+}
+
+func (s *SizeError) Error() string {
+	return fmt.Sprintf("invalid %s length %d, min %d max %d", s.Kind, s.Size, s.Min, s.Max)
+}
+
+func (r *Reader) maxDocumentSize() int64 {
+	if r.MaxDocumentSize > 0 {
+		return int64(r.MaxDocumentSize)
+	}
+	return DefaultMaxBsonObjectSize
+}
+
+/*
+命令文档的最大长度,插入的文档等用户数据不允许使用多出的16KB
+*/
+func (r *Reader) maxCommandSize() int64 {
+	return r.maxDocumentSize() + bsonObjectSizeSlack
+}
+
+/*
+文档的解码方式,raw字段总是会被填充
+*/
+type DocumentMode int
+
+const (
+	// 解码为bson.M,会丢失key的顺序
+	DocumentMap DocumentMode = iota
+	// 解码为bson.D,保留key的顺序(包括嵌套文档)
+	DocumentOrdered
+	// 只保留bson.Raw,由使用者自行解码
+	DocumentRaw
+)
+
 func (r *Reader) ReadInt32() (n int32, err error) {
 	err = binary.Read(r, binary.LittleEndian, &n)
 	return
@@ -41,6 +102,8 @@ func (r *Reader) ReadBytes(n int) ([]byte, error) {
 
 const CStringEndByte = '\x00'
 
+const bsonDocumentKind = 0x03
+
 func (r *Reader) ReadCString() (string, error) {
 	var b []byte
 	var one = make([]byte, 1)
@@ -58,6 +121,10 @@ func (r *Reader) ReadCString() (string, error) {
 }
 
 func (r *Reader) ReadOne() ([]byte, error) {
+	return r.readOne(r.maxDocumentSize())
+}
+
+func (r *Reader) readOne(max int64) ([]byte, error) {
 	docLen, err := r.ReadInt32()
 	if err != nil {
 		if err == io.EOF {
@@ -65,6 +132,9 @@ func (r *Reader) ReadOne() ([]byte, error) {
 		}
 		return nil, err
 	}
+	if int64(docLen) < minDocumentSize || int64(docLen) > max {
+		return nil, &SizeError{Kind: "document", Size: int64(docLen), Min: minDocumentSize, Max: max}
+	}
 	buf := make([]byte, int(docLen))
 	binary.LittleEndian.PutUint32(buf, uint32(docLen))
 	if _, err := io.ReadFull(r, buf[4:]); err != nil {
@@ -85,6 +155,88 @@ func (r *Reader) ReadDocument() (m bson.M, e error) {
 	return
 }
 
+func (r *Reader) ReadDocumentD() (d bson.D, e error) {
+	bytes, e := r.ReadOne()
+	if e != nil && e != io.EOF {
+		return
+	}
+	if bytes != nil {
+		e = bson.Unmarshal(bytes, &d)
+	}
+	return
+}
+
+func (r *Reader) ReadRawDocument() (raw bson.Raw, e error) {
+	return r.readRawDocument(r.maxDocumentSize())
+}
+
+func (r *Reader) readRawDocument(max int64) (raw bson.Raw, e error) {
+	bytes, e := r.readOne(max)
+	if e != nil && e != io.EOF {
+		return
+	}
+	if bytes != nil {
+		raw = bson.Raw{Kind: bsonDocumentKind, Data: bytes}
+	}
+	return
+}
+
+/*
+按Mode读取一个文档,m与d只会填充其中一个(DocumentRaw时都不填充),raw总是填充
+*/
+func (r *Reader) readDocumentAs() (m bson.M, d bson.D, raw bson.Raw, e error) {
+	return r.readDocumentLimit(r.maxDocumentSize())
+}
+
+/*
+按命令文档的限制读取一个文档
+*/
+func (r *Reader) readCommandAs() (m bson.M, d bson.D, raw bson.Raw, e error) {
+	return r.readDocumentLimit(r.maxCommandSize())
+}
+
+func (r *Reader) readDocumentLimit(max int64) (m bson.M, d bson.D, raw bson.Raw, e error) {
+	raw, e = r.readRawDocument(max)
+	if e != nil || raw.Data == nil {
+		return
+	}
+	switch r.Mode {
+	case DocumentOrdered:
+		e = bson.Unmarshal(raw.Data, &d)
+	case DocumentMap:
+		e = bson.Unmarshal(raw.Data, &m)
+	}
+	return
+}
+
+func (r *Reader) readDocumentsAs() (ms []bson.M, ds []bson.D, raws []bson.Raw, e error) {
+	return r.readDocumentsLimit(r.maxDocumentSize())
+}
+
+func (r *Reader) readDocumentsLimit(max int64) (ms []bson.M, ds []bson.D, raws []bson.Raw, e error) {
+	raws = make([]bson.Raw, 0)
+	for {
+		m, d, raw, e := r.readDocumentLimit(max)
+		if e != nil && e != io.EOF {
+			return ms, ds, raws, e
+		}
+		if raw.Data == nil {
+			break
+		}
+		raws = append(raws, raw)
+		switch r.Mode {
+		case DocumentOrdered:
+			ds = append(ds, d)
+		case DocumentMap:
+			ms = append(ms, m)
+		}
+	}
+	if r.Mode == DocumentMap && ms == nil {
+		ms = make([]bson.M, 0)
+	}
+	return ms, ds, raws, nil
+}
+
 func (r *Reader) ReadDocuments() (ms []bson.M, e error) {
 	ms = make([]bson.M, 0)
 	for {
@@ -102,3 +254,114 @@ func (r *Reader) ReadDocuments() (ms []bson.M, e error) {
 	}
 	return
 }
+
+/*
+读取一个完整的消息帧,返回header与body(不含header)
+*/
+func readMessage(r io.Reader) (*MsgHeader, []byte, error) {
+	return readMessageLimit(r, DefaultMaxMessageSizeBytes)
+}
+
+/*
+messageLength不合法时返回header与SizeError,body不会被读取
+*/
+func readMessageLimit(r io.Reader, maxSize int32) (*MsgHeader, []byte, error) {
+	header := &MsgHeader{}
+	if e := binary.Read(r, binary.LittleEndian, header); e != nil {
+		return nil, nil, e
+	}
+	if header.MessageLength < 4*4 || header.MessageLength > maxSize {
+		return header, nil, &SizeError{Kind: "message", Size: int64(header.MessageLength), Min: 4 * 4, Max: int64(maxSize)}
+	}
+	body := make([]byte, header.MessageLength-4*4)
+	if _, e := io.ReadFull(r, body); e != nil {
+		return nil, nil, e
+	}
+	return header, body, nil
+}
+
+/*
+读取一个消息帧,OP_COMPRESSED会被解压,返回的header为原始消息的header
+*/
+func ReadMessage(r io.Reader, mode DocumentMode) (*MsgHeader, *Reader, error) {
+	header, body, e := readMessage(r)
+	if e != nil {
+		return nil, nil, e
+	}
+	if header.OpCode == OP_COMPRESSED {
+		if header, body, _, e = decompressMessage(header, body); e != nil {
+			return nil, nil, e
+		}
+	}
+	return header, &Reader{Reader: bytes.NewReader(body), Header: header, Mode: mode}, nil
+}
+
+/*
+按opCode创建对应的消息,responseTo不为0的OP_MSG视为回复
+*/
+func NewMessage(header *MsgHeader) (UnMarshaler, error) {
+	switch header.OpCode {
+	case OP_REPLY:
+		return &Reply{}, nil
+	case OP_UPDATE:
+		return &Update{}, nil
+	case OP_INSERT:
+		return &Insert{}, nil
+	case OP_QUERY:
+		return &Query{}, nil
+	case OP_GET_MORE:
+		return &GetMore{}, nil
+	case OP_DELETE:
+		return &Delete{}, nil
+	case OP_KILL_CURSORS:
+		return &KillCursors{}, nil
+	case OP_MSG:
+		if header.ResponseTo != 0 {
+			return &MsgReply{}, nil
+		}
+		return &Msg{}, nil
+	}
+	return nil, fmt.Errorf("unsupported opCode %v", header.OpCode)
+}
+
+/*
+读取并解码一个消息,可用于客户端读取回复,代理或流量分析
+*/
+func DecodeMessage(r io.Reader, mode DocumentMode) (*MsgHeader, UnMarshaler, error) {
+	header, reader, e := ReadMessage(r, mode)
+	if e != nil {
+		return nil, nil, e
+	}
+	return decodeMessage(header, reader)
+}
+
+/*
+解码一个已读取的消息body(不含header)
+*/
+func ParseMessage(header *MsgHeader, body []byte, mode DocumentMode) (UnMarshaler, error) {
+	_, message, e := decodeMessage(header, &Reader{Reader: bytes.NewReader(body), Header: header, Mode: mode})
+	return message, e
+}
+
+/*
+将消息编码为header与body(不含header),与ParseMessage相对
+*/
+func EncodeMessage(w Writer) (*MsgHeader, []byte, error) {
+	buffer := &bytes.Buffer{}
+	if e := w.Write(buffer); e != nil {
+		return nil, nil, e
+	}
+	header, body, e := readMessage(buffer)
+	return header, body, e
+}
+
+func decodeMessage(header *MsgHeader, reader *Reader) (*MsgHeader, UnMarshaler, error) {
+	message, e := NewMessage(header)
+	if e != nil {
+		return header, nil, e
+	}
+	if e := message.UnMarshal(reader); e != nil {
+		return header, nil, e
+	}
+	return header, message, nil
+}
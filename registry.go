@@ -0,0 +1,160 @@
+package mongo_protocol
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var lastOperationID int64
+
+/*
+一个正在处理的请求,Server为每个请求创建,处理完成后移除
+*/
+type Operation struct {
+	ID      int64
+	Conn    *ConnContext
+	Header  *MsgHeader
+	Started time.Time
+	body    []byte
+	ctx     context.Context
+	cancel  context.CancelFunc
+	killed  int32
+}
+
+/*
+killOp或连接关闭时被取消,耗时较长的Handler应当检查并返回CodeInterrupted错误
+*/
+func (o *Operation) Context() context.Context {
+	return o.ctx
+}
+
+func (o *Operation) Killed() bool {
+	return atomic.LoadInt32(&o.killed) != 0
+}
+
+func (o *Operation) Kill() {
+	atomic.StoreInt32(&o.killed, 1)
+	o.cancel()
+}
+
+/*
+解码请求消息,见ParseMessage
+*/
+func (o *Operation) Message(mode DocumentMode) (UnMarshaler, error) {
+	return ParseMessage(o.Header, o.body, mode)
+}
+
+/*
+连接的快照
+*/
+type ConnectionInfo struct {
+	ID         int64
+	RemoteAddr string
+	AcceptedAt time.Time
+	Client     *ClientMetadata
+	User       *AuthenticatedUser
+	// 是否正在处理请求
+	Active bool
+}
+
+func (server *Server) startOperation(connContext *ConnContext, header *MsgHeader, body []byte) *Operation {
+	ctx, cancel := context.WithCancel(connContext.Context())
+	op := &Operation{
+		ID:      atomic.AddInt64(&lastOperationID, 1),
+		Conn:    connContext,
+		Header:  header,
+		Started: time.Now(),
+		body:    body,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	server.lock.Lock()
+	server.ops[op.ID] = op
+	server.lock.Unlock()
+	connContext.setOperation(op)
+	return op
+}
+
+func (server *Server) finishOperation(op *Operation) {
+	op.Conn.setOperation(nil)
+	server.lock.Lock()
+	delete(server.ops, op.ID)
+	server.lock.Unlock()
+	op.cancel()
+}
+
+/*
+当前所有连接,按连接id排序
+*/
+func (server *Server) Connections() []*ConnectionInfo {
+	server.lock.Lock()
+	conns := make(map[*ConnContext]bool, len(server.conns))
+	for connContext, active := range server.conns {
+		conns[connContext] = active
+	}
+	server.lock.Unlock()
+	result := make([]*ConnectionInfo, 0, len(conns))
+	for connContext, active := range conns {
+		result = append(result, &ConnectionInfo{
+			ID:         connContext.ID(),
+			RemoteAddr: connContext.RemoteAddr().String(),
+			AcceptedAt: connContext.AcceptedAt(),
+			Client:     connContext.ClientMetadata(),
+			User:       connContext.User(),
+			Active:     active,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+/*
+强制关闭一个连接,正在处理的请求会被取消;连接不存在时返回false
+*/
+func (server *Server) CloseConnection(id int64) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for connContext := range server.conns {
+		if connContext.ID() == id {
+			if op := connContext.Operation(); op != nil {
+				op.Kill()
+			}
+			_ = connContext.Conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+/*
+当前正在处理的请求,按id排序
+*/
+func (server *Server) Operations() []*Operation {
+	server.lock.Lock()
+	result := make([]*Operation, 0, len(server.ops))
+	for _, op := range server.ops {
+		result = append(result, op)
+	}
+	server.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+/*
+中断一个请求,请求不存在时返回false
+*/
+func (server *Server) KillOp(id int64) bool {
+	server.lock.Lock()
+	op, ok := server.ops[id]
+	server.lock.Unlock()
+	if ok {
+		op.Kill()
+	}
+	return ok
+}
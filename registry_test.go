@@ -0,0 +1,81 @@
+package mongo_protocol
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func waitOperations(t *testing.T, server *Server, n int) {
+	for i := 0; len(server.Operations()) != n; i++ {
+		if i > 200 {
+			t.Fatalf("expected %d operations, got %d", n, len(server.Operations()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCurrentOpAndKillOp(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	NewAdmin(server).Register(router)
+	router.Handle("sleep", func(cmd *Command) (interface{}, error) {
+		<-cmd.Conn.Operation().Context().Done()
+		return nil, NewCommandError(CodeInterrupted, "operation was interrupted")
+	})
+	server.AddHandler(OP_MSG, router)
+	sleeper := newHandshakeTestConn(server)
+	defer sleeper.Close()
+	admin := newHandshakeTestConn(server)
+	defer admin.Close()
+
+	sendTestMsg(t, sleeper, 1, 0, bson.D{{Name: "sleep", Value: "users"}, {Name: "$db", Value: "test"}})
+	waitOperations(t, server, 1)
+
+	sendTestMsg(t, admin, 2, 0, bson.D{{Name: "currentOp", Value: 1}, {Name: "op", Value: "command"}, {Name: "$db", Value: "admin"}})
+	_, msg := readTestMsg(t, admin)
+	inprog := msg.GetBodyMsgSection()["inprog"].([]interface{})
+	var sleeping bson.M
+	for _, v := range inprog {
+		if op := v.(bson.M); op["ns"] == "test.users" {
+			sleeping = op
+		}
+	}
+	if len(inprog) != 2 || sleeping == nil || sleeping["active"] != true {
+		t.Fatalf("unexpected inprog %v", inprog)
+	}
+	if command := sleeping["command"].(bson.M); command["sleep"] != "users" {
+		t.Fatalf("unexpected command %v", command)
+	}
+
+	sendTestMsg(t, admin, 3, 0, bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: sleeping["opid"]}, {Name: "$db", Value: "admin"}})
+	readTestMsg(t, admin)
+	_, msg = readTestMsg(t, sleeper)
+	if body := msg.GetBodyMsgSection(); body["code"] != int(CodeInterrupted) {
+		t.Fatalf("expected Interrupted, got %v", body)
+	}
+	//请求在回复写出之后才从注册表中移除
+	waitOperations(t, server, 0)
+
+	sendTestMsg(t, admin, 4, 0, bson.D{{Name: "currentOp", Value: 1}, {Name: "$all", Value: true}, {Name: "active", Value: false}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, admin)
+	if inprog := msg.GetBodyMsgSection()["inprog"].([]interface{}); len(inprog) != 1 || inprog[0].(bson.M)["connectionId"] != sleeping["connectionId"] {
+		t.Fatalf("unexpected idle connections %v", inprog)
+	}
+
+	id := sleeping["connectionId"].(int64)
+	found := false
+	for _, conn := range server.Connections() {
+		found = found || conn.ID == id
+	}
+	if len(server.Connections()) != 2 || !found {
+		t.Fatalf("unexpected connections %v", server.Connections())
+	}
+	if !server.CloseConnection(id) {
+		t.Fatal("connection not found")
+	}
+	expectClosed(t, sleeper)
+	if server.KillOp(-1) || server.CloseConnection(-1) {
+		t.Fatal("expected unknown ids to be rejected")
+	}
+}
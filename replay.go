@@ -0,0 +1,358 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+比较回复时默认忽略的字段,这些字段每次执行都会变化
+*/
+var DefaultReplayIgnoreFields = []string{"localTime", "connectionId", "operationTime", "$clusterTime", "checksum"}
+
+type ReplayOptions struct {
+	// 建立到目标服务的连接,录制中的每个连接对应一个新连接
+	Dial func() (net.Conn, error)
+	// 回放速度,1为原始速度,2为两倍速,0为不等待
+	Speed float64
+	// 等待每个回复的超时,0为不超时
+	Timeout time.Duration
+	// 比较回复时忽略的字段名(任意层级),为nil时使用DefaultReplayIgnoreFields
+	IgnoreFields []string
+}
+
+/*
+一个请求的回复与录制的回复不一致
+*/
+type ReplayDiff struct {
+	ConnectionID int64
+	RequestID    int32
+	OpCode       OpCode
+	// 命令名称,非OP_MSG/OP_QUERY时为空
+	Command     string
+	Differences []string
+}
+
+type ReplayReport struct {
+	Connections int
+	Requests    int
+	Replies     int
+	Diffs       []*ReplayDiff
+	// 连接级别的错误,如连接失败或读取超时,该连接之后的请求不再回放
+	Errors []error
+}
+
+/*
+回复与录制完全一致且没有错误
+*/
+func (r *ReplayReport) OK() bool {
+	return len(r.Diffs) == 0 && len(r.Errors) == 0
+}
+
+func (r *ReplayReport) WriteTo(w io.Writer) (int64, error) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "connections: %d, requests: %d, replies: %d, diffs: %d, errors: %d\n",
+		r.Connections, r.Requests, r.Replies, len(r.Diffs), len(r.Errors))
+	for _, diff := range r.Diffs {
+		fmt.Fprintf(b, "connection %d request %d %s %s:\n", diff.ConnectionID, diff.RequestID, opCodeName(diff.OpCode), diff.Command)
+		for _, v := range diff.Differences {
+			fmt.Fprintf(b, "    %s\n", v)
+		}
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(b, "error: %v\n", e)
+	}
+	n, e := io.WriteString(w, b.String())
+	return int64(n), e
+}
+
+type replayRequest struct {
+	record   *CaptureRecord
+	expected []*CaptureRecord
+}
+
+/*
+按录制的连接与时间回放请求,每个原始连接使用一个并发的新连接,
+并将收到的回复与录制的回复逐字段比较
+*/
+func Replay(ctx context.Context, records []*CaptureRecord, options *ReplayOptions) *ReplayReport {
+	report := &ReplayReport{Diffs: make([]*ReplayDiff, 0), Errors: make([]error, 0)}
+	if len(records) == 0 {
+		return report
+	}
+	ignore := options.IgnoreFields
+	if ignore == nil {
+		ignore = DefaultReplayIgnoreFields
+	}
+	ignored := make(map[string]bool)
+	for _, v := range ignore {
+		ignored[v] = true
+	}
+	sessions := groupReplayRequests(records)
+	report.Connections = len(sessions)
+	start := time.Now()
+	origin := records[0].Time
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for id, requests := range sessions {
+		wg.Add(1)
+		go func(id int64, requests []*replayRequest) {
+			defer wg.Done()
+			s := &replaySession{id: id, options: options, ignored: ignored, start: start, origin: origin}
+			diffs, sent, replies, e := s.run(ctx, requests)
+			lock.Lock()
+			defer lock.Unlock()
+			report.Diffs = append(report.Diffs, diffs...)
+			report.Requests += sent
+			report.Replies += replies
+			if e != nil {
+				report.Errors = append(report.Errors, fmt.Errorf("connection %d: %v", id, e))
+			}
+		}(id, requests)
+	}
+	wg.Wait()
+	sort.Slice(report.Diffs, func(i, j int) bool {
+		if report.Diffs[i].ConnectionID != report.Diffs[j].ConnectionID {
+			return report.Diffs[i].ConnectionID < report.Diffs[j].ConnectionID
+		}
+		return report.Diffs[i].RequestID < report.Diffs[j].RequestID
+	})
+	return report
+}
+
+/*
+按连接分组,并按responseTo找到每个请求录制的回复(exhaust时为多个)
+*/
+func groupReplayRequests(records []*CaptureRecord) map[int64][]*replayRequest {
+	sessions := make(map[int64][]*replayRequest)
+	replies := make(map[int64]map[int32]*CaptureRecord)
+	for _, record := range records {
+		if record.Direction != CaptureReply {
+			continue
+		}
+		if replies[record.ConnectionID] == nil {
+			replies[record.ConnectionID] = make(map[int32]*CaptureRecord)
+		}
+		replies[record.ConnectionID][record.Header.ResponseTo] = record
+	}
+	for _, record := range records {
+		if record.Direction != CaptureRequest {
+			continue
+		}
+		request := &replayRequest{record: record, expected: make([]*CaptureRecord, 0)}
+		responseTo := record.Header.RequestID
+		for {
+			reply, ok := replies[record.ConnectionID][responseTo]
+			if !ok {
+				break
+			}
+			request.expected = append(request.expected, reply)
+			if reply.Header.OpCode != OP_MSG || !hasMoreToCome(reply.Body()) {
+				break
+			}
+			responseTo = reply.Header.RequestID
+		}
+		sessions[record.ConnectionID] = append(sessions[record.ConnectionID], request)
+	}
+	return sessions
+}
+
+type replaySession struct {
+	id      int64
+	options *ReplayOptions
+	ignored map[string]bool
+	start   time.Time
+	origin  time.Time
+}
+
+func (s *replaySession) run(ctx context.Context, requests []*replayRequest) (diffs []*ReplayDiff, sent int, replies int, e error) {
+	conn, e := s.options.Dial()
+	if e != nil {
+		return nil, 0, 0, e
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	for _, request := range requests {
+		if e := s.wait(ctx, request.record.Time); e != nil {
+			return diffs, sent, replies, e
+		}
+		if _, e := conn.Write(request.record.Frame); e != nil {
+			return diffs, sent, replies, e
+		}
+		sent++
+		actual := make([]*CaptureRecord, 0)
+		if expectReply(request.record.Header.OpCode, request.record.Body()) {
+			for {
+				if s.options.Timeout > 0 {
+					_ = conn.SetReadDeadline(time.Now().Add(s.options.Timeout))
+				}
+				header, body, e := readMessage(conn)
+				if e != nil {
+					return diffs, sent, replies, e
+				}
+				if header.OpCode == OP_COMPRESSED {
+					if header, body, _, e = decompressMessage(header, body); e != nil {
+						return diffs, sent, replies, e
+					}
+				}
+				replies++
+				actual = append(actual, &CaptureRecord{Direction: CaptureReply, Header: header, Frame: append(headerBytes(header), body...)})
+				if header.OpCode != OP_MSG || !hasMoreToCome(body) {
+					break
+				}
+			}
+		}
+		if diff := s.compare(request, actual); diff != nil {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, sent, replies, nil
+}
+
+/*
+等待到录制中该请求相对于第一条记录的时间点(按Speed缩放)
+*/
+func (s *replaySession) wait(ctx context.Context, t time.Time) error {
+	if s.options.Speed <= 0 {
+		return ctx.Err()
+	}
+	offset := time.Duration(float64(t.Sub(s.origin)) / s.options.Speed)
+	delay := time.Until(s.start.Add(offset))
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *replaySession) compare(request *replayRequest, actual []*CaptureRecord) *ReplayDiff {
+	diff := &ReplayDiff{
+		ConnectionID: s.id,
+		RequestID:    request.record.Header.RequestID,
+		OpCode:       request.record.Header.OpCode,
+		Command:      commandName(request.record),
+		Differences:  make([]string, 0),
+	}
+	if len(actual) != len(request.expected) {
+		diff.Differences = append(diff.Differences, fmt.Sprintf("expected %d replies, got %d", len(request.expected), len(actual)))
+	}
+	for i := 0; i < len(actual) && i < len(request.expected); i++ {
+		expected, actual := request.expected[i], actual[i]
+		path := fmt.Sprintf("reply[%d]", i)
+		if expected.Header.OpCode != actual.Header.OpCode {
+			diff.Differences = append(diff.Differences, fmt.Sprintf("%s.opCode: expected %v, got %v", path, opCodeName(expected.Header.OpCode), opCodeName(actual.Header.OpCode)))
+			continue
+		}
+		e, ee := expected.Message(DocumentOrdered)
+		a, ae := actual.Message(DocumentOrdered)
+		if ee != nil || ae != nil {
+			diff.Differences = append(diff.Differences, fmt.Sprintf("%s: decode error expected=%v actual=%v", path, ee, ae))
+			continue
+		}
+		diff.Differences = append(diff.Differences, diffValues(path, MessageDocument(e), MessageDocument(a), s.ignored)...)
+	}
+	if len(diff.Differences) == 0 {
+		return nil
+	}
+	return diff
+}
+
+func headerBytes(header *MsgHeader) []byte {
+	buffer := &bytes.Buffer{}
+	_ = binary.Write(buffer, binary.LittleEndian, header)
+	return buffer.Bytes()
+}
+
+/*
+OP_MSG与OP_QUERY的命令名称,用于报告
+*/
+func commandName(record *CaptureRecord) string {
+	message, e := record.Message(DocumentOrdered)
+	if e != nil {
+		return ""
+	}
+	switch m := message.(type) {
+	case *Msg:
+		if body := m.GetBodyMsgSectionD(); len(body) > 0 {
+			return body[0].Name
+		}
+	case *Query:
+		if len(m.QueryD) > 0 {
+			return m.QueryD[0].Name
+		}
+	}
+	return ""
+}
+
+/*
+逐字段比较,返回不一致字段的路径,如 reply[0].sections.0.body.n
+*/
+func diffValues(path string, expected, actual interface{}, ignored map[string]bool) []string {
+	switch e := expected.(type) {
+	case bson.D:
+		a, ok := actual.(bson.D)
+		if !ok {
+			break
+		}
+		result := make([]string, 0)
+		am := a.Map()
+		for _, elem := range e {
+			if ignored[elem.Name] {
+				continue
+			}
+			v, ok := am[elem.Name]
+			if !ok {
+				result = append(result, fmt.Sprintf("%s.%s: missing", path, elem.Name))
+				continue
+			}
+			result = append(result, diffValues(path+"."+elem.Name, elem.Value, v, ignored)...)
+		}
+		em := e.Map()
+		for _, elem := range a {
+			if _, ok := em[elem.Name]; !ok && !ignored[elem.Name] {
+				result = append(result, fmt.Sprintf("%s.%s: unexpected", path, elem.Name))
+			}
+		}
+		return result
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			break
+		}
+		result := make([]string, 0)
+		for i := range e {
+			result = append(result, diffValues(fmt.Sprintf("%s.%d", path, i), e[i], a[i], ignored)...)
+		}
+		return result
+	}
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	ej, _ := ExtendedJSON(expected)
+	aj, _ := ExtendedJSON(actual)
+	return []string{fmt.Sprintf("%s: expected %s, got %s", path, ej, aj)}
+}
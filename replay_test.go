@@ -0,0 +1,103 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplayTestServer(n int) *Server {
+	router := NewCommandRouter()
+	router.Handle("echo", func(cmd *Command) (interface{}, error) {
+		return bson.D{{Name: "value", Value: cmd.Value()}, {Name: "localTime", Value: time.Now()}, {Name: "ok", Value: 1.0}}, nil
+	})
+	router.Handle("count", func(cmd *Command) (interface{}, error) {
+		return bson.D{{Name: "n", Value: n}, {Name: "ok", Value: 1.0}}, nil
+	})
+	server := NewServer(`0`)
+	server.AddHandler(OP_MSG, router)
+	return server
+}
+
+func recordReplayTestTraffic(t *testing.T) []*CaptureRecord {
+	capture := &bytes.Buffer{}
+	writer, e := NewCaptureWriter(capture)
+	if e != nil {
+		t.Fatal(e)
+	}
+	server := newReplayTestServer(3)
+	server.AddHandler(OP_MSG, NewRecordHandler(server.GetHandler(OP_MSG), writer))
+	for c := 0; c < 2; c++ {
+		client, conn := net.Pipe()
+		go server.handler(context.TODO(), conn)
+		sendTestMsg(t, client, 1, 0, bson.D{{Name: "echo", Value: "hi"}, {Name: "$db", Value: "test"}})
+		readTestMsg(t, client)
+		sendTestMsg(t, client, 2, 0, bson.D{{Name: "count", Value: "users"}, {Name: "$db", Value: "test"}})
+		readTestMsg(t, client)
+		client.Close()
+	}
+	reader, e := NewCaptureReader(capture)
+	if e != nil {
+		t.Fatal(e)
+	}
+	records, e := reader.ReadAll()
+	if e != nil {
+		t.Fatal(e)
+	}
+	return records
+}
+
+func replayTestOptions(server *Server) *ReplayOptions {
+	return &ReplayOptions{
+		Dial: func() (net.Conn, error) {
+			client, conn := net.Pipe()
+			go server.handler(context.TODO(), conn)
+			return client, nil
+		},
+		Timeout: time.Second,
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records := recordReplayTestTraffic(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report := Replay(ctx, records, replayTestOptions(newReplayTestServer(3)))
+	if !report.OK() || report.Connections != 2 || report.Requests != 4 || report.Replies != 4 {
+		out := &strings.Builder{}
+		_, _ = report.WriteTo(out)
+		t.Fatalf("unexpected report %s", out)
+	}
+
+	report = Replay(ctx, records, replayTestOptions(newReplayTestServer(4)))
+	if len(report.Diffs) != 2 || len(report.Errors) != 0 {
+		t.Fatalf("expected 2 diffs, got %d %v", len(report.Diffs), report.Errors)
+	}
+	diff := report.Diffs[0]
+	if diff.Command != "count" || diff.RequestID != 2 || len(diff.Differences) != 1 || diff.Differences[0] != "reply[0].sections.0.body.n: expected 3, got 4" {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	records := recordReplayTestTraffic(t)
+	last := records[0].Time.Add(200 * time.Millisecond)
+	for _, record := range records[len(records)/2:] {
+		record.Time = last
+	}
+	options := replayTestOptions(newReplayTestServer(3))
+	options.Speed = 2
+	start := time.Now()
+	report := Replay(context.Background(), records, options)
+	if !report.OK() {
+		t.Fatalf("unexpected errors %v", report.Errors)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("unexpected elapsed %v", elapsed)
+	}
+}
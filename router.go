@@ -0,0 +1,580 @@
+package mongo_protocol
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+一条已解码的命令,OP_MSG与OP_QUERY($cmd)都会被转换为Command
+*/
+type Command struct {
+	// 命令名称,即命令文档的第一个key
+	Name string
+	// 命令所在的数据库,OP_MSG取自$db,OP_QUERY取自fullCollectionName
+	Database string
+	// 有序的命令文档,嵌套文档同样为bson.D
+	Body bson.D
+	// 命令文档的原始bson
+	Raw bson.Raw
+	// OP_MSG中kind=1的section,按identifier分组
+	Sequences map[string][]bson.D
+	Header    *MsgHeader
+	// 请求为OP_MSG时不为nil
+	Msg *Msg
+	// 请求为OP_QUERY时不为nil
+	Query *Query
+	Conn  *ConnContext
+}
+
+/*
+命令文档的第一个值,如 {find:"users"} 中的 "users"
+*/
+func (c *Command) Value() interface{} {
+	if len(c.Body) == 0 {
+		return nil
+	}
+	return c.Body[0].Value
+}
+
+/*
+替换命令文档,同时更新Raw
+*/
+func (c *Command) setBody(body bson.D) error {
+	raw, e := bson.Marshal(body)
+	if e != nil {
+		return e
+	}
+	c.Body = body
+	c.Raw = bson.Raw{Kind: bsonDocumentKind, Data: raw}
+	return nil
+}
+
+/*
+以bson.M的形式返回命令文档,嵌套文档同样为bson.M
+*/
+func (c *Command) Map() bson.M {
+	m := bson.M{}
+	if c.Raw.Data != nil {
+		_ = c.Raw.Unmarshal(&m)
+	}
+	return m
+}
+
+/*
+命令处理函数,返回的文档(bson.M,bson.D或其他可序列化的值)将以请求对应的协议回复;
+返回nil表示已自行回复(如使用MsgStream)或无需回复
+*/
+type CommandHandler func(cmd *Command) (interface{}, error)
+
+/*
+按命令名称分发OP_MSG与OP_QUERY命令,命令名称不区分大小写,
+因此 isMaster/ismaster, buildinfo/buildInfo 只需注册一次
+*/
+type CommandRouter struct {
+	handlers      map[string]CommandHandler
+	queryHandlers []QueryHandler
+	// 找不到命令时调用,为nil时返回错误
+	NotFound CommandHandler
+}
+
+func NewCommandRouter() *CommandRouter {
+	return &CommandRouter{
+		handlers:      make(map[string]CommandHandler),
+		queryHandlers: make([]QueryHandler, 0),
+	}
+}
+
+/*
+与mongod一致,命令名称区分大小写,只有以下命令可以使用别名
+*/
+var commandAliases = map[string]string{
+	"ismaster":      "isMaster",
+	"buildinfo":     "buildInfo",
+	"getlasterror":  "getLastError",
+	"getpreverror":  "getPrevError",
+	"reseterror":    "resetError",
+	"findandmodify": "findAndModify",
+	"dbstats":       "dbStats",
+	"collstats":     "collStats",
+}
+
+func canonicalCommandName(name string) string {
+	if canonical, ok := commandAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+func (router *CommandRouter) Handle(name string, handler CommandHandler) {
+	router.handlers[canonicalCommandName(name)] = handler
+}
+
+func (router *CommandRouter) GetHandler(name string) (CommandHandler, bool) {
+	h, ok := router.handlers[canonicalCommandName(name)]
+	return h, ok
+}
+
+/*
+非$cmd的OP_QUERY(旧版驱动的find)交由QueryHandler处理,没有QueryHandler支持时转换为find命令
+*/
+func (router *CommandRouter) AddQueryHandler(handler QueryHandler) {
+	router.queryHandlers = append(router.queryHandlers, handler)
+}
+
+func (router *CommandRouter) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	r.Mode = DocumentOrdered
+	switch header.OpCode {
+	case OP_MSG:
+		return router.processMsg(header, r, conn)
+	case OP_QUERY:
+		return router.processQuery(header, r, conn)
+	case OP_GET_MORE:
+		return router.processLegacyGetMore(header, r, conn)
+	case OP_INSERT, OP_UPDATE, OP_DELETE:
+		return router.processLegacyWrite(header, r, conn)
+	}
+	_, _ = ioutil.ReadAll(r)
+	return fmt.Errorf("unsupported opCode %v", header.OpCode)
+}
+
+func (router *CommandRouter) processMsg(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	msg := &Msg{}
+	if e := msg.UnMarshal(r); e != nil {
+		return e
+	}
+	cmd := &Command{
+		Body:      msg.GetBodyMsgSectionD(),
+		Raw:       msg.GetBodyMsgSectionRaw(),
+		Sequences: make(map[string][]bson.D),
+		Header:    header,
+		Msg:       msg,
+		Conn:      conn,
+	}
+	for _, v := range msg.Sections {
+		if section, ok := v.(*DocumentSequenceMsgSection); ok {
+			ident := section.DocumentSequenceIdentifier
+			cmd.Sequences[ident] = append(cmd.Sequences[ident], section.DocumentSequencesD...)
+		}
+	}
+	if len(cmd.Body) > 0 {
+		cmd.Name = cmd.Body[0].Name
+	}
+	for _, v := range cmd.Body {
+		if v.Name == "$db" {
+			cmd.Database, _ = v.Value.(string)
+		}
+	}
+	result, e := router.dispatch(cmd)
+	if e != nil {
+		logrus.Debugf("[router]command %s error:%v", cmd.Name, e)
+		result = ToCommandError(e).Document()
+	}
+	if result == nil {
+		return nil
+	}
+	reply := NewMsgReply(header.RequestID)
+	section := NewBodyMsgSection()
+	if e := setReplyBody(section, result); e != nil {
+		return e
+	}
+	reply.Sections = append(reply.Sections, section)
+	return reply.Write(conn)
+}
+
+func (router *CommandRouter) processQuery(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	query := &Query{}
+	if e := query.UnMarshal(r); e != nil {
+		return e
+	}
+	query.Header = *header
+	database, collection := splitNamespace(query.FullCollectionName)
+	if collection != "$cmd" {
+		return router.processLegacyQuery(header, query, conn)
+	}
+	cmd := &Command{
+		Database: database,
+		Body:     query.QueryD,
+		Raw:      query.QueryRaw,
+		Header:   header,
+		Query:    query,
+		Conn:     conn,
+	}
+	// 旧版驱动会把命令包装在 {$query:{...}, $readPreference:{...}} 中
+	body, modifiers := unwrapLegacyQuery(query.QueryD)
+	if modifiers != nil || query.Flags.Has(SlaveOk) {
+		if readPreference, ok := modifiers.Map()["$readPreference"]; ok {
+			body = append(body, bson.DocElem{Name: "$readPreference", Value: readPreference})
+		}
+		if e := cmd.setBody(withSlaveOk(body, query.Flags)); e != nil {
+			return e
+		}
+	}
+	if len(cmd.Body) > 0 {
+		cmd.Name = cmd.Body[0].Name
+	}
+	result, e := router.dispatch(cmd)
+	if e != nil {
+		//$cmd命令的错误以普通文档返回,不设置QueryFailure
+		result = ToCommandError(e).Document()
+	}
+	if result == nil {
+		return nil
+	}
+	reply := NewReply(header.RequestID)
+	reply.AddDocument(result)
+	return reply.Write(conn)
+}
+
+/*
+优先交给支持该查询的QueryHandler(flags见query.Flags);没有时转换为find命令,
+游标id不为0且设置了Exhaust时继续以getMore命令连续回复,直到游标结束
+*/
+func (router *CommandRouter) processLegacyQuery(header *MsgHeader, query *Query, conn *ConnContext) error {
+	for _, h := range router.queryHandlers {
+		if !h.Support(query) {
+			continue
+		}
+		reply := NewReply(header.RequestID)
+		if e := h.Process(query, reply); e != nil {
+			return e
+		}
+		return reply.Write(conn)
+	}
+	database, collection := splitNamespace(query.FullCollectionName)
+	cmd := &Command{Name: "find", Database: database, Header: header, Query: query, Conn: conn}
+	if e := cmd.setBody(legacyFindCommand(query)); e != nil {
+		return e
+	}
+	reply, e := router.dispatchCursor(cmd, header.RequestID)
+	if e != nil {
+		return e
+	}
+	for {
+		reply.Header.RequestID = nextRequestID()
+		if e := reply.Write(conn); e != nil {
+			return e
+		}
+		if !query.Flags.Has(Exhaust) || reply.CursorID == 0 {
+			return nil
+		}
+		cmd = &Command{Name: "getMore", Database: database, Header: header, Query: query, Conn: conn}
+		if e := cmd.setBody(getMoreCommand(reply.CursorID, database, collection, query.NumberToReturn)); e != nil {
+			return e
+		}
+		startingFrom := reply.StartingFrom + reply.NumberReturned
+		if reply, e = router.dispatchCursor(cmd, reply.Header.RequestID); e != nil {
+			return e
+		}
+		reply.StartingFrom = startingFrom
+	}
+}
+
+/*
+OP_GET_MORE转换为getMore命令,游标不存在时回复CursorNotFound
+*/
+func (router *CommandRouter) processLegacyGetMore(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	getMore := &GetMore{}
+	if e := getMore.UnMarshal(r); e != nil {
+		return e
+	}
+	var cursorID int64
+	if getMore.CursorID != nil {
+		cursorID = *getMore.CursorID
+	}
+	database, collection := splitNamespace(getMore.FullCollectionName)
+	cmd := &Command{Name: "getMore", Database: database, Header: header, Conn: conn}
+	if e := cmd.setBody(getMoreCommand(cursorID, database, collection, getMore.NumberToReturn)); e != nil {
+		return e
+	}
+	reply, e := router.dispatchCursor(cmd, header.RequestID)
+	if e != nil {
+		if ToCommandError(e).Code != CodeCursorNotFound {
+			return e
+		}
+		reply = NewReply(header.RequestID)
+		reply.ResponseFlags.Set(CursorNotFound)
+	}
+	return reply.Write(conn)
+}
+
+/*
+执行find/getMore命令,把回复中的游标 {cursor:{id, firstBatch|nextBatch}} 转换为OP_REPLY
+*/
+func (router *CommandRouter) dispatchCursor(cmd *Command, responseTo int32) (*Reply, error) {
+	result, e := router.dispatch(cmd)
+	if e != nil {
+		return nil, e
+	}
+	out, e := bson.Marshal(result)
+	if e != nil {
+		return nil, e
+	}
+	doc := bson.M{}
+	if e := bson.Unmarshal(out, &doc); e != nil {
+		return nil, e
+	}
+	if !isOk(doc["ok"]) {
+		return nil, commandErrorFromReply(doc)
+	}
+	cursor := &struct {
+		Cursor struct {
+			ID         interface{} `bson:"id"`
+			FirstBatch []bson.Raw  `bson:"firstBatch"`
+			NextBatch  []bson.Raw  `bson:"nextBatch"`
+		} `bson:"cursor"`
+	}{}
+	if e := bson.Unmarshal(out, cursor); e != nil {
+		return nil, e
+	}
+	reply := NewReply(responseTo)
+	reply.ResponseFlags.Set(AwaitCapable)
+	reply.CursorID, _ = int64Value(cursor.Cursor.ID)
+	for _, v := range append(cursor.Cursor.FirstBatch, cursor.Cursor.NextBatch...) {
+		reply.AddDocument(v)
+	}
+	return reply, nil
+}
+
+/*
+{$query:{...}, $orderby:{...}} 拆分为查询条件与修饰符,没有包装时modifiers为nil
+*/
+func unwrapLegacyQuery(query bson.D) (bson.D, bson.D) {
+	if len(query) > 0 && (query[0].Name == "$query" || query[0].Name == "query") {
+		if inner, ok := query[0].Value.(bson.D); ok {
+			return inner, query[1:]
+		}
+	}
+	return query, nil
+}
+
+/*
+SlaveOk等价于 $readPreference:{mode:"secondaryPreferred"},已有$readPreference时不修改
+*/
+func withSlaveOk(body bson.D, flags QueryFlags) bson.D {
+	if !flags.Has(SlaveOk) {
+		return body
+	}
+	if _, ok := body.Map()["$readPreference"]; ok {
+		return body
+	}
+	return append(body, bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}})
+}
+
+/*
+旧版修饰符对应的find命令参数
+*/
+var legacyQueryModifiers = map[string]string{
+	"$orderby":     "sort",
+	"$hint":        "hint",
+	"$comment":     "comment",
+	"$maxTimeMS":   "maxTimeMS",
+	"$max":         "max",
+	"$min":         "min",
+	"$returnKey":   "returnKey",
+	"$showDiskLoc": "showRecordId",
+	"$snapshot":    "snapshot",
+}
+
+/*
+旧版查询对应的find命令,flags对应tailable,awaitData,noCursorTimeout,oplogReplay,allowPartialResults
+与$readPreference;numberToReturn为负数或1时只返回一批
+*/
+func legacyFindCommand(query *Query) bson.D {
+	database, collection := splitNamespace(query.FullCollectionName)
+	filter, modifiers := unwrapLegacyQuery(query.QueryD)
+	if filter == nil {
+		filter = bson.D{}
+	}
+	body := bson.D{{Name: "find", Value: collection}, {Name: "filter", Value: filter}}
+	if query.ReturnFieldsSelectorD != nil {
+		body = append(body, bson.DocElem{Name: "projection", Value: query.ReturnFieldsSelectorD})
+	}
+	if query.NumberToSkip > 0 {
+		body = append(body, bson.DocElem{Name: "skip", Value: query.NumberToSkip})
+	}
+	switch n := query.NumberToReturn; {
+	case n < 0:
+		body = append(body, bson.DocElem{Name: "limit", Value: -n}, bson.DocElem{Name: "singleBatch", Value: true})
+	case n == 1:
+		body = append(body, bson.DocElem{Name: "limit", Value: n}, bson.DocElem{Name: "singleBatch", Value: true})
+	case n > 1:
+		body = append(body, bson.DocElem{Name: "batchSize", Value: n})
+	}
+	for _, v := range modifiers {
+		if name, ok := legacyQueryModifiers[v.Name]; ok {
+			v.Name = name
+		}
+		body = append(body, v)
+	}
+	for _, v := range []struct {
+		flag QueryFlags
+		name string
+	}{
+		{TailableCursor, "tailable"},
+		{AwaitData, "awaitData"},
+		{NoCursorTimeout, "noCursorTimeout"},
+		{OplogReplay, "oplogReplay"},
+		{Partial, "allowPartialResults"},
+	} {
+		if query.Flags.Has(v.flag) {
+			body = append(body, bson.DocElem{Name: v.name, Value: true})
+		}
+	}
+	body = withSlaveOk(body, query.Flags)
+	return append(body, bson.DocElem{Name: "$db", Value: database})
+}
+
+func getMoreCommand(cursorID int64, database, collection string, numberToReturn int32) bson.D {
+	body := bson.D{{Name: "getMore", Value: cursorID}, {Name: "collection", Value: collection}}
+	if numberToReturn > 1 {
+		body = append(body, bson.DocElem{Name: "batchSize", Value: numberToReturn})
+	}
+	return append(body, bson.DocElem{Name: "$db", Value: database})
+}
+
+/*
+旧版驱动的OP_INSERT/OP_UPDATE/OP_DELETE转换为insert/update/delete命令,
+flags转换为对应的命令参数,这些请求没有回复,结果记录在连接上由getLastError返回.
+OP_INSERT的每个文档单独执行,没有设置ContinueOnError时在第一个错误处停止
+*/
+func (router *CommandRouter) processLegacyWrite(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	var ns, name, sequence string
+	var documents []bson.D
+	ordered := true
+	switch header.OpCode {
+	case OP_INSERT:
+		insert := &Insert{}
+		if e := insert.UnMarshal(r); e != nil {
+			return e
+		}
+		ns, name, sequence = insert.FullCollectionName, "insert", "documents"
+		documents = insert.DocumentsD
+		ordered = !insert.Flags.Has(ContinueOnError)
+	case OP_UPDATE:
+		update := &Update{}
+		if e := update.UnMarshal(r); e != nil {
+			return e
+		}
+		ns, name, sequence = update.FullCollectionName, "update", "updates"
+		documents = []bson.D{{
+			{Name: "q", Value: update.SelectorD},
+			{Name: "u", Value: update.UpdateD},
+			{Name: "upsert", Value: update.Flags.Has(Upsert)},
+			{Name: "multi", Value: update.Flags.Has(MultiUpdate)},
+		}}
+	case OP_DELETE:
+		del := &Delete{}
+		if e := del.UnMarshal(r); e != nil {
+			return e
+		}
+		ns, name, sequence = del.FullCollectionName, "delete", "deletes"
+		limit := 0
+		if del.Flags.Has(SingleRemove) {
+			limit = 1
+		}
+		documents = []bson.D{{
+			{Name: "q", Value: del.SelectorD},
+			{Name: "limit", Value: limit},
+		}}
+	}
+	database, collection := splitNamespace(ns)
+	lastError := &LastError{}
+	for _, document := range documents {
+		cmd := &Command{
+			Name:      name,
+			Database:  database,
+			Sequences: map[string][]bson.D{sequence: {document}},
+			Header:    header,
+			Conn:      conn,
+		}
+		body := bson.D{{Name: name, Value: collection}, {Name: "ordered", Value: ordered}, {Name: "$db", Value: database}}
+		if e := cmd.setBody(body); e != nil {
+			return e
+		}
+		n, e := writeResult(router.dispatch(cmd))
+		lastError.N += n
+		if e != nil {
+			logrus.Warnf("[router]legacy %s on %s error:%v", name, ns, e)
+			lastError.Err = e
+			if ordered {
+				break
+			}
+		}
+	}
+	conn.SetLastError(lastError)
+	return nil
+}
+
+/*
+写命令的结果转换为影响的文档数与第一个错误(命令失败或writeErrors)
+*/
+func writeResult(result interface{}, e error) (int, *CommandError) {
+	if e != nil {
+		return 0, ToCommandError(e)
+	}
+	out, e := bson.Marshal(result)
+	if e != nil {
+		return 0, ToCommandError(e)
+	}
+	doc := bson.M{}
+	if e := bson.Unmarshal(out, &doc); e != nil {
+		return 0, ToCommandError(e)
+	}
+	if !isOk(doc["ok"]) {
+		return 0, commandErrorFromReply(doc)
+	}
+	n, _ := int64Value(doc["n"])
+	if writeErrors, ok := doc["writeErrors"].([]interface{}); ok && len(writeErrors) > 0 {
+		if writeError, ok := writeErrors[0].(bson.M); ok {
+			return int(n), commandErrorFromReply(writeError)
+		}
+	}
+	return int(n), nil
+}
+
+func (router *CommandRouter) dispatch(cmd *Command) (interface{}, error) {
+	logrus.Debugf("[router]dispatch command %s on db %s", cmd.Name, cmd.Database)
+	h, ok := router.GetHandler(cmd.Name)
+	if !ok {
+		if router.NotFound == nil {
+			return nil, NewCommandError(CodeCommandNotFound, "no such command: '%s'", cmd.Name)
+		}
+		h = router.NotFound
+	}
+	return h(cmd)
+}
+
+func setReplyBody(section *BodyMsgSection, result interface{}) error {
+	switch v := result.(type) {
+	case bson.D:
+		section.BodyD = v
+	case bson.M:
+		section.Body = v
+	case map[string]interface{}:
+		section.Body = v
+	case bson.Raw:
+		section.BodyRaw = v
+	default:
+		out, e := bson.Marshal(result)
+		if e != nil {
+			return e
+		}
+		section.BodyRaw = bson.Raw{Kind: bsonDocumentKind, Data: out}
+	}
+	return nil
+}
+
+/*
+"db.collection" 拆分为 db 与 collection
+*/
+func splitNamespace(ns string) (string, string) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return ns, ""
+	}
+	return ns[:i], ns[i+1:]
+}
@@ -0,0 +1,360 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"testing"
+)
+
+func sendTestQuery(t *testing.T, w io.Writer, requestID int32, ns string, query interface{}) {
+	q := &Query{FullCollectionName: ns, NumberToReturn: -1}
+	q.Header.RequestID = requestID
+	switch v := query.(type) {
+	case bson.D:
+		q.QueryD = v
+	case bson.M:
+		q.Query = v
+	}
+	if e := q.Write(w); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func readTestReply(t *testing.T, r io.Reader) (*MsgHeader, bson.M) {
+	header, body, e := readMessage(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if header.OpCode != OP_REPLY {
+		t.Fatalf("expected OP_REPLY, got %v", header.OpCode)
+	}
+	reader := &Reader{Reader: bytes.NewReader(body[4+8+4+4:])}
+	doc, e := reader.ReadDocument()
+	if e != nil && e != io.EOF {
+		t.Fatal(e)
+	}
+	return header, doc
+}
+
+func newRouterTestServer() *CommandRouter {
+	router := NewCommandRouter()
+	router.Handle("find", func(cmd *Command) (interface{}, error) {
+		return bson.M{
+			"ok":     1,
+			"db":     cmd.Database,
+			"coll":   cmd.Value(),
+			"first":  cmd.Body[1].Name,
+			"seqLen": len(cmd.Sequences["documents"]),
+		}, nil
+	})
+	router.Handle("isMaster", func(cmd *Command) (interface{}, error) {
+		return bson.D{{Name: "ismaster", Value: true}, {Name: "ok", Value: 1}}, nil
+	})
+	return router
+}
+
+func TestCommandRouterMsg(t *testing.T) {
+	server := NewServer(`0`)
+	router := newRouterTestServer()
+	server.AddHandler(OP_MSG, router)
+	server.AddHandler(OP_QUERY, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	request := NewMsgReply(0)
+	request.Header.RequestID = 1
+	body := NewBodyMsgSection()
+	body.BodyD = bson.D{
+		{Name: "find", Value: "users"},
+		{Name: "sort", Value: bson.D{{Name: "b", Value: -1}}},
+		{Name: "filter", Value: bson.M{}},
+		{Name: "$db", Value: "test"},
+	}
+	sequence := NewDocumentSequenceMsgSection()
+	sequence.DocumentSequenceIdentifier = "documents"
+	sequence.DocumentSequences = []bson.M{{"a": 1}, {"a": 2}}
+	request.Sections = append(request.Sections, body, sequence)
+	if e := request.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	header, msg := readTestMsg(t, client)
+	reply := msg.GetBodyMsgSection()
+	if header.ResponseTo != 1 || reply["db"] != "test" || reply["coll"] != "users" || reply["first"] != "sort" || reply["seqLen"] != 2 {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+
+	sendTestMsg(t, client, 2, 0, bson.D{{Name: "ismaster", Value: 1}, {Name: "$db", Value: "admin"}})
+	_, msg = readTestMsg(t, client)
+	if msg.GetBodyMsgSection()["ismaster"] != true {
+		t.Fatalf("unexpected reply %v", msg.GetBodyMsgSection())
+	}
+
+	//命令名称区分大小写,只有别名表中的名称可以使用
+	for i, name := range []string{"ISMASTER", "FIND"} {
+		sendTestMsg(t, client, int32(3+i), 0, bson.D{{Name: name, Value: 1}, {Name: "$db", Value: "admin"}})
+		_, msg = readTestMsg(t, client)
+		if msg.GetBodyMsgSection()["code"] != int(CodeCommandNotFound) {
+			t.Fatalf("%s: expected CommandNotFound, got %v", name, msg.GetBodyMsgSection())
+		}
+	}
+}
+
+func TestCommandRouterQuery(t *testing.T) {
+	server := NewServer(`0`)
+	router := newRouterTestServer()
+	server.AddHandler(OP_MSG, router)
+	server.AddHandler(OP_QUERY, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestQuery(t, client, 3, "admin.$cmd", bson.D{{Name: "ismaster", Value: 1}})
+	header, reply := readTestReply(t, client)
+	if header.ResponseTo != 3 || reply["ismaster"] != true {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+
+	query := bson.D{
+		{Name: "$query", Value: bson.D{{Name: "find", Value: "orders"}, {Name: "limit", Value: 1}}},
+		{Name: "$readPreference", Value: bson.M{"mode": "secondaryPreferred"}},
+	}
+	sendTestQuery(t, client, 4, "shop.$cmd", query)
+	_, reply = readTestReply(t, client)
+	if reply["db"] != "shop" || reply["coll"] != "orders" || reply["first"] != "limit" {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+}
+
+type listQueryHandler struct {
+}
+
+func (l *listQueryHandler) Support(query *Query) bool {
+	return query.FullCollectionName == "test.users"
+}
+
+func (l *listQueryHandler) Process(query *Query, reply *Reply) error {
+	for i := 0; i < 3; i++ {
+		reply.AddDocument(bson.M{"_id": i})
+	}
+	return nil
+}
+
+func TestLegacyQueryMultipleDocuments(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	router.AddQueryHandler(&listQueryHandler{})
+	server.AddHandler(OP_QUERY, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestQuery(t, client, 1, "test.users", bson.M{})
+	header, body, e := readMessage(client)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reply := &Reply{}
+	if e := reply.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	if reply.ResponseFlags != 0 || reply.NumberReturned != 3 || reply.Documents[2].(bson.M)["_id"] != 2 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+}
+
+func TestLegacyWriteFlags(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	commands := make(chan *Command, 3)
+	record := func(cmd *Command) (interface{}, error) {
+		commands <- cmd
+		return bson.M{"ok": 1}, nil
+	}
+	router.Handle("insert", record)
+	router.Handle("update", record)
+	router.Handle("delete", record)
+	server.AddHandler(OP_INSERT, router)
+	server.AddHandler(OP_UPDATE, router)
+	server.AddHandler(OP_DELETE, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	insert := &Insert{Flags: ContinueOnError, FullCollectionName: "test.users", Documents: []bson.M{{"_id": 1}, {"_id": 2}}}
+	if e := insert.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	//每个文档单独执行
+	for i := 1; i <= 2; i++ {
+		cmd := <-commands
+		m := cmd.Map()
+		documents := cmd.Sequences["documents"]
+		if cmd.Name != "insert" || cmd.Database != "test" || m["insert"] != "users" || m["ordered"] != false || len(documents) != 1 || documents[0].Map()["_id"] != i {
+			t.Fatalf("unexpected insert command %v %v", cmd.Body, cmd.Sequences)
+		}
+	}
+
+	update := &Update{FullCollectionName: "test.users", Flags: Upsert | MultiUpdate, Selector: bson.M{"_id": 1}, Update: bson.M{"$set": bson.M{"a": 1}}}
+	if e := update.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	cmd := <-commands
+	updates := cmd.Sequences["updates"][0].Map()
+	if cmd.Name != "update" || updates["upsert"] != true || updates["multi"] != true {
+		t.Fatalf("unexpected update command %v %v", cmd.Body, cmd.Sequences)
+	}
+
+	del := &Delete{FullCollectionName: "test.users", Flags: SingleRemove, Selector: bson.M{"_id": 1}}
+	if e := del.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	cmd = <-commands
+	if cmd.Name != "delete" || cmd.Sequences["deletes"][0].Map()["limit"] != 1 {
+		t.Fatalf("unexpected delete command %v %v", cmd.Body, cmd.Sequences)
+	}
+}
+
+/*
+旧版写操作的错误通过getLastError返回,没有ContinueOnError时在第一个错误处停止
+*/
+func TestLegacyWriteLastError(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	NewHandshake(server).Register(router)
+	inserted := make([]interface{}, 0)
+	router.Handle("insert", func(cmd *Command) (interface{}, error) {
+		doc := cmd.Sequences["documents"][0].Map()
+		if doc["_id"] == 2 {
+			return nil, NewCommandError(CodeDuplicateKey, "duplicate key: %v", doc["_id"])
+		}
+		inserted = append(inserted, doc["_id"])
+		return bson.M{"n": 1, "ok": 1.0}, nil
+	})
+	server.AddHandler(OP_INSERT, router)
+	server.AddHandler(OP_QUERY, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	for i, flags := range []InsertFlags{0, ContinueOnError} {
+		inserted = inserted[:0]
+		insert := &Insert{Flags: flags, FullCollectionName: "test.users", Documents: []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}}}
+		if e := insert.Write(client); e != nil {
+			t.Fatal(e)
+		}
+		sendTestQuery(t, client, int32(i+1), "test.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+		_, reply := readTestReply(t, client)
+		expected := []interface{}{1}
+		if flags.Has(ContinueOnError) {
+			expected = []interface{}{1, 3}
+		}
+		if reply["n"] != len(expected) || reply["code"] != int(CodeDuplicateKey) || reply["err"] != "duplicate key: 2" {
+			t.Fatalf("unexpected getLastError %v", reply)
+		}
+		if fmt.Sprint(inserted) != fmt.Sprint(expected) {
+			t.Fatalf("flags %v: inserted %v, expected %v", flags, inserted, expected)
+		}
+	}
+
+	insert := &Insert{FullCollectionName: "test.users", Documents: []bson.M{{"_id": 4}}}
+	if e := insert.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	sendTestQuery(t, client, 3, "test.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	if _, reply := readTestReply(t, client); reply["n"] != 1 || reply["err"] != nil || reply["code"] != nil {
+		t.Fatalf("unexpected getLastError %v", reply)
+	}
+}
+
+func TestLegacyQueryFlags(t *testing.T) {
+	server := NewServer(`0`)
+	router := NewCommandRouter()
+	commands := make(chan *Command, 4)
+	router.Handle("find", func(cmd *Command) (interface{}, error) {
+		commands <- cmd
+		return bson.M{"cursor": bson.M{"id": int64(7), "ns": "test.users", "firstBatch": []bson.M{{"_id": 1}, {"_id": 2}}}, "ok": 1.0}, nil
+	})
+	getMores := 0
+	router.Handle("getMore", func(cmd *Command) (interface{}, error) {
+		commands <- cmd
+		getMores++
+		id := int64(7)
+		if getMores == 2 {
+			id = 0
+		}
+		return bson.M{"cursor": bson.M{"id": id, "ns": "test.users", "nextBatch": []bson.M{{"_id": getMores + 2}}}, "ok": 1.0}, nil
+	})
+	router.Handle("ping", func(cmd *Command) (interface{}, error) {
+		commands <- cmd
+		return bson.M{"ok": 1.0}, nil
+	})
+	server.AddHandler(OP_QUERY, router)
+	server.AddHandler(OP_GET_MORE, router)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	flags := TailableCursor | AwaitData | NoCursorTimeout | SlaveOk | Partial | Exhaust
+	query := bson.D{{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}}, {Name: "$orderby", Value: bson.D{{Name: "b", Value: 1}}}}
+	request := &Query{Flags: flags, FullCollectionName: "test.users", NumberToReturn: 2, QueryD: query}
+	request.Header.RequestID = 1
+	if e := request.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	find := (<-commands).Map()
+	if find["find"] != "users" || find["filter"].(bson.M)["a"] != 1 || find["sort"].(bson.M)["b"] != 1 || find["batchSize"] != 2 ||
+		find["tailable"] != true || find["awaitData"] != true || find["noCursorTimeout"] != true || find["allowPartialResults"] != true ||
+		find["$readPreference"].(bson.M)["mode"] != "secondaryPreferred" {
+		t.Fatalf("unexpected find command %v", find)
+	}
+	//Exhaust时连续回复,每个回复的responseTo是上一个回复的requestID
+	responseTo := int32(1)
+	for i, expected := range []struct {
+		cursorID     int64
+		startingFrom int32
+		returned     int32
+	}{{7, 0, 2}, {7, 2, 1}, {0, 3, 1}} {
+		header, body, e := readMessage(client)
+		if e != nil {
+			t.Fatal(e)
+		}
+		reply := &Reply{}
+		if e := reply.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header}); e != nil {
+			t.Fatal(e)
+		}
+		if header.ResponseTo != responseTo || reply.CursorID != expected.cursorID || reply.StartingFrom != expected.startingFrom ||
+			reply.NumberReturned != expected.returned || !reply.ResponseFlags.Has(AwaitCapable) {
+			t.Fatalf("reply %d: unexpected %v %+v", i, *header, reply)
+		}
+		if i > 0 {
+			if getMore := (<-commands).Map(); getMore["getMore"] != int64(7) || getMore["collection"] != "users" {
+				t.Fatalf("unexpected getMore command %v", getMore)
+			}
+		}
+		responseTo = header.RequestID
+	}
+
+	cursorID := int64(9)
+	if e := (&GetMore{FullCollectionName: "test.users", CursorID: &cursorID}).Write(client); e != nil {
+		t.Fatal(e)
+	}
+	<-commands
+	_, doc := readTestReply(t, client)
+	if doc["_id"] != 5 {
+		t.Fatalf("unexpected getMore reply %v", doc)
+	}
+
+	request = &Query{Flags: SlaveOk, FullCollectionName: "admin.$cmd", NumberToReturn: -1, QueryD: bson.D{{Name: "ping", Value: 1}}}
+	if e := request.Write(client); e != nil {
+		t.Fatal(e)
+	}
+	if ping := (<-commands).Map(); ping["$readPreference"].(bson.M)["mode"] != "secondaryPreferred" {
+		t.Fatalf("unexpected ping command %v", ping)
+	}
+	readTestReply(t, client)
+}
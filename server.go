@@ -1,43 +1,324 @@
 package mongo_protocol
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	shutdownPollInterval       = 10 * time.Millisecond
+	DefaultTLSHandshakeTimeout = 10 * time.Second
 )
 
 type Server struct {
-	Port           string
-	handlerMap     map[OpCode]Handler
-	defaultHandler Handler
+	Port string
+	// 监听的ip,多个ip以逗号分隔,为空时监听所有网卡
+	BindAddress string
+	// 额外监听的unix socket,如 /tmp/mongodb-27017.sock,不使用TLS
+	UnixSocketPath string
+	// 最大连接数,0为不限制;超过时直接关闭新连接,QueueExcessConnections时已Accept的连接等待其他连接关闭后再处理
+	MaxConnections         int
+	QueueExcessConnections bool
+	// 等待下一个请求的最长时间,0为不限制
+	IdleTimeout time.Duration
+	// 请求开始后读完整个消息的最长时间,0为不限制
+	ReadTimeout time.Duration
+	// 每次写出回复的最长时间,0为不限制
+	WriteTimeout time.Duration
+	// TLS握手的最长时间,为0时使用DefaultTLSHandshakeTimeout
+	TLSHandshakeTimeout time.Duration
+	// 消息与单个文档的最大长度,为0时使用默认值,握手时会告知客户端;消息超过限制时回复错误并关闭连接
+	MaxMessageSizeBytes int32
+	MaxBsonObjectSize   int32
+	handlerMap          map[OpCode]Handler
+	defaultHandler      Handler
+	compressors         []Compressor
+	documentMode        DocumentMode
+	middlewares         []func(Handler) Handler
+	lock                sync.Mutex
+	listeners           map[net.Listener]struct{}
+	// 连接是否正在处理请求,Shutdown时空闲的连接会被直接关闭
+	conns map[*ConnContext]bool
+	// 正在处理的请求,key为Operation.ID
+	ops        map[int64]*Operation
+	inShutdown int32
+	shutdownCh chan struct{}
+	// 正在运行的handler,Shutdown等待其全部退出
+	handlers  sync.WaitGroup
+	tlsConfig *tls.Config
+	slots     chan struct{}
+	slotsOnce sync.Once
+	stats     ServerStats
 }
 
+/*
+监听BindAddress:Port(以及UnixSocketPath)并处理连接,ctx取消时停止监听并返回nil,
+调用Shutdown后返回ErrServerClosed
+*/
 func (server *Server) Start(ctx context.Context) error {
-	listener, e := net.Listen(`tcp`, fmt.Sprintf(`:%s`, server.Port))
+	listeners, e := server.listen()
 	if e != nil {
 		return e
 	}
-	for {
+	result := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			result <- server.serve(ctx, listener)
+		}(listener)
+	}
+	//任意一个监听退出时关闭其他监听
+	e = <-result
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-result
+	}
+	return e
+}
+
+func (server *Server) listen() ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0)
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	if server.Port != "" {
+		for _, ip := range strings.Split(server.BindAddress, ",") {
+			listener, e := net.Listen(`tcp`, net.JoinHostPort(strings.TrimSpace(ip), server.Port))
+			if e != nil {
+				closeAll()
+				return nil, e
+			}
+			listeners = append(listeners, server.tlsListener(listener))
+		}
+	}
+	if server.UnixSocketPath != "" {
+		//与mongod一样,删除上次未正常退出时残留的socket文件
+		if e := os.Remove(server.UnixSocketPath); e != nil && !os.IsNotExist(e) {
+			closeAll()
+			return nil, e
+		}
+		listener, e := net.Listen(`unix`, server.UnixSocketPath)
+		if e != nil {
+			closeAll()
+			return nil, e
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("neither Port nor UnixSocketPath is set")
+	}
+	return listeners, nil
+}
+
+/*
+在给定的listener上处理连接,直到Shutdown或listener被关闭;设置了TLS时连接需要TLS握手
+*/
+func (server *Server) Serve(listener net.Listener) error {
+	return server.serve(context.Background(), server.tlsListener(listener))
+}
+
+func (server *Server) tlsListener(listener net.Listener) net.Listener {
+	if server.tlsConfig != nil {
+		return tls.NewListener(listener, server.tlsConfig)
+	}
+	return listener
+}
+
+func (server *Server) serve(ctx context.Context, listener net.Listener) error {
+	if !server.trackListener(listener, true) {
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(listener, false)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
 		select {
 		case <-ctx.Done():
-			return listener.Close()
-		default:
-			conn, e := listener.Accept()
-			if e != nil {
-				logrus.Errorf(`[server]accept port [%s] connection error:%v`, server.Port, e)
+			_ = listener.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		conn, e := listener.Accept()
+		if e != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				logrus.Errorf(`[server]accept [%s] connection error:%v`, listener.Addr(), e)
+				time.Sleep(5 * time.Millisecond)
 				continue
 			}
-			go server.handler(ctx, conn)
+			return e
+		}
+		if server.QueueExcessConnections {
+			//多个listener共用连接数,在Accept之后等待,空闲的listener不会占用连接数
+			if !server.waitConnectionSlot(ctx) {
+				_ = conn.Close()
+				if server.shuttingDown() {
+					return ErrServerClosed
+				}
+				return nil
+			}
+		} else if !server.acquireConnectionSlot(conn) {
+			continue
+		}
+		if !server.goHandler(ctx, conn) {
+			_ = conn.Close()
+			server.releaseConnectionSlot()
+			return ErrServerClosed
+		}
+		atomic.AddInt64(&server.stats.TotalConnections, 1)
+	}
+}
+
+/*
+服务关闭之前为连接启动handler;与Shutdown使用同一把锁,保证Shutdown开始等待之后不会再有新的handler
+*/
+func (server *Server) goHandler(ctx context.Context, conn net.Conn) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.shuttingDown() {
+		return false
+	}
+	server.handlers.Add(1)
+	go func() {
+		defer server.handlers.Done()
+		defer server.releaseConnectionSlot()
+		server.handler(ctx, conn)
+	}()
+	return true
+}
+
+func (server *Server) trackListener(listener net.Listener, add bool) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if add {
+		if server.shuttingDown() {
+			return false
+		}
+		server.listeners[listener] = struct{}{}
+	} else {
+		delete(server.listeners, listener)
+	}
+	return true
+}
+
+func (server *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&server.inShutdown) != 0
+}
+
+/*
+设置连接的状态,返回false表示服务正在关闭,连接应当退出
+*/
+func (server *Server) setConnState(connContext *ConnContext, active bool) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if _, ok := server.conns[connContext]; !ok {
+		return false
+	}
+	server.conns[connContext] = active
+	return active || !server.shuttingDown()
+}
+
+/*
+优雅关闭:立即停止监听,关闭空闲连接,等待处理中的请求完成后关闭其连接,
+所有handler退出后返回nil;ctx先结束时强制关闭剩余连接并返回ctx.Err()
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&server.inShutdown, 0, 1) {
+		close(server.shutdownCh)
+	}
+	server.lock.Lock()
+	for listener := range server.listeners {
+		_ = listener.Close()
+	}
+	server.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		server.closeIdleConns()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			server.lock.Lock()
+			for connContext := range server.conns {
+				_ = connContext.Conn.Close()
+			}
+			server.lock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+关闭所有空闲连接
+*/
+func (server *Server) closeIdleConns() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for connContext, active := range server.conns {
+		if !active {
+			_ = connContext.Conn.Close()
 		}
 	}
 }
 
 func (server *Server) handler(ctx context.Context, conn net.Conn) {
 	connContext := NewConnContext(conn)
+	connContext.writeTimeout = server.WriteTimeout
 	defer connContext.Close()
+	//握手之前就登记为空闲连接,Shutdown可以关闭握手中的连接
+	server.lock.Lock()
+	if server.shuttingDown() {
+		server.lock.Unlock()
+		return
+	}
+	server.conns[connContext] = false
+	server.lock.Unlock()
+	defer func() {
+		server.lock.Lock()
+		delete(server.conns, connContext)
+		server.lock.Unlock()
+	}()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		_ = tlsConn.SetDeadline(time.Now().Add(server.tlsHandshakeTimeout()))
+		if e := tlsConn.Handshake(); e != nil {
+			if isTimeout(e) {
+				atomic.AddInt64(&server.stats.DroppedReadTimeout, 1)
+			}
+			logrus.Warnf(`[server]tls handshake error:%v from [%s]`, e, conn.RemoteAddr())
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+	}
 	defer func() {
 		if e := recover(); e != nil {
 			logrus.Errorf(`[server]process error:%v on port [%s]`, e, server.Port)
@@ -48,22 +329,62 @@ func (server *Server) handler(ctx context.Context, conn net.Conn) {
 		case <-ctx.Done():
 			return
 		default:
-			header := &MsgHeader{}
-			e := binary.Read(connContext, binary.LittleEndian, header)
+			header, body, e := server.readRequest(connContext)
 			if e != nil {
-				if e != io.EOF {
+				if sizeError, ok := e.(*SizeError); ok && header != nil {
+					//帧已经无法继续解析,回复错误后关闭连接
+					logrus.Warnf(`[server]%v from [%s] on port [%s]`, sizeError, connContext.RemoteAddr(), server.Port)
+					writeError(readOriginalHeader(connContext, header), sizeError, connContext)
+					return
+				}
+				if e != io.EOF && !isTimeout(e) && !server.shuttingDown() {
 					logrus.Errorf(`[server]unexpected error:%v on port [%s]`, e, server.Port)
 				}
-				break
+				return
+			}
+			var compressor Compressor
+			if header.OpCode == OP_COMPRESSED {
+				compressedHeader := header
+				header, body, compressor, e = decompressMessageLimit(compressedHeader, body, server.maxMessageSize(), func(c Compressor) bool {
+					return server.compressorAllowed(connContext, c)
+				})
+				if e != nil {
+					logrus.Errorf(`[server]decompress error:%v on port [%s]`, e, server.Port)
+					if header == nil {
+						header = compressedHeader
+					}
+					writeError(header, e, connContext)
+					if _, ok := e.(*SizeError); ok {
+						return
+					}
+					if !server.setConnState(connContext, false) {
+						return
+					}
+					continue
+				}
+			}
+			connContext.setRequest(header, compressor, header.OpCode == OP_MSG && hasMoreToCome(body))
+			op := server.startOperation(connContext, header, body)
+			server.process(header, connContext, &Reader{
+				Reader:          bytes.NewReader(body),
+				Header:          header,
+				Mode:            server.documentMode,
+				MaxDocumentSize: server.maxBsonObjectSize(),
+			})
+			server.finishOperation(op)
+			connContext.setRequest(nil, nil, false)
+			if connContext.timedOut() {
+				atomic.AddInt64(&server.stats.DroppedWriteTimeout, 1)
+				return
+			}
+			if !server.setConnState(connContext, false) {
+				return
 			}
-			rd := io.LimitReader(connContext, int64(header.MessageLength-4*4))
-			r := &Reader{rd}
-			server.process(header, connContext, e, r)
 		}
 	}
 }
 
-func (server *Server) process(header *MsgHeader, connContext *ConnContext, e error, r *Reader) {
+func (server *Server) process(header *MsgHeader, connContext *ConnContext, r *Reader) {
 	defer func() {
 		if e := recover(); e != nil {
 			writeError(header, e, connContext)
@@ -72,35 +393,47 @@ func (server *Server) process(header *MsgHeader, connContext *ConnContext, e err
 	logrus.Debugf("[server]process command header.OpCode:%v", header.OpCode)
 	h, ok := server.handlerMap[header.OpCode]
 	if !ok {
-		e = server.defaultHandler.Process(header, r, connContext)
-	} else {
-		e = h.Process(header, r, connContext)
+		h = server.defaultHandler
 	}
-	if e != nil {
+	for i := len(server.middlewares) - 1; i >= 0; i-- {
+		h = server.middlewares[i](h)
+	}
+	if e := h.Process(header, r, connContext); e != nil {
 		logrus.Errorf(`[server]process error:%v on port [%s]`, e, server.Port)
 		writeError(header, e, connContext)
 	}
 }
 
 func writeError(header *MsgHeader, e interface{}, connContext *ConnContext) {
-	reply := NewErrorReply(header, fmt.Sprintf("%v", e))
+	if connContext.timedOut() {
+		return
+	}
+	reply := NewErrorReply(header, ToCommandError(e))
+	if reply == nil {
+		return
+	}
 	if e := reply.Write(connContext); e != nil {
 		panic(e)
 	}
 }
 
-func NewErrorReply(header *MsgHeader, msg string) *Reply {
-	reply := NewReply(header.RequestID)
-	reply.NumberReturned = 1
+/*
+按请求的opCode生成错误回复,OP_INSERT等没有回复的请求返回nil
+*/
+func NewErrorReply(header *MsgHeader, e *CommandError) Writer {
 	switch header.OpCode {
-	case OP_QUERY:
-		reply.ResponseFlags = QueryFailure
-		reply.Documents = map[string]interface{}{"$err": msg}
 	case OP_MSG:
-		//TODO:msg 消息回复
-		reply.ResponseFlags = 0
-		reply.Documents = map[string]interface{}{"errmsg": msg}
+		reply := NewMsgReply(header.RequestID)
+		section := NewBodyMsgSection()
+		section.Body = e.Document()
+		reply.Sections = append(reply.Sections, section)
+		return reply
+	case OP_INSERT, OP_UPDATE, OP_DELETE, OP_KILL_CURSORS:
+		return nil
 	}
+	reply := NewReply(header.RequestID)
+	reply.ResponseFlags = QueryFailure
+	reply.AddDocument(e.QueryFailureDocument())
 	return reply
 }
 
@@ -116,10 +449,106 @@ func (server *Server) SetDefaultHandler(handler Handler) {
 	server.defaultHandler = handler
 }
 
+/*
+添加中间件,作用于所有opCode(包括defaultHandler),先添加的中间件在外层
+*/
+func (server *Server) Use(middleware ...func(Handler) Handler) {
+	server.middlewares = append(server.middlewares, middleware...)
+}
+
+/*
+设置传递给Handler的Reader的文档解码方式,Handler也可以在解码前自行修改Reader.Mode
+*/
+func (server *Server) SetDocumentMode(mode DocumentMode) {
+	server.documentMode = mode
+}
+
+/*
+启用TLS,之后Start与Serve监听的tcp连接都需要TLS握手,为nil时关闭TLS
+*/
+func (server *Server) SetTLSConfig(config *tls.Config) {
+	server.tlsConfig = config
+}
+
+/*
+使用证书文件启用TLS,见TLSConfig
+*/
+func (server *Server) SetTLS(config *TLSConfig) error {
+	tlsConfig, e := config.Build()
+	if e != nil {
+		return e
+	}
+	server.tlsConfig = tlsConfig
+	return nil
+}
+
+/*
+设置服务端支持的压缩器,按优先级排列,如 snappy,zlib,zstd
+*/
+func (server *Server) SetCompressors(names ...string) error {
+	list := make([]Compressor, 0, len(names))
+	for _, name := range names {
+		c, ok := GetCompressorByName(name)
+		if !ok {
+			return fmt.Errorf("unsupported compressor %s", name)
+		}
+		list = append(list, c)
+	}
+	server.compressors = list
+	return nil
+}
+
+/*
+根据客户端握手时的compression字段协商压缩器,返回值用于回复中的compression字段
+*/
+func (server *Server) NegotiateCompression(requested []string) []string {
+	result := make([]string, 0)
+	for _, name := range requested {
+		for _, c := range server.compressors {
+			if c.Name() == name {
+				result = append(result, name)
+			}
+		}
+	}
+	return result
+}
+
+/*
+客户端只能使用服务端启用并且在握手时为该连接协商过的压缩器
+*/
+func (server *Server) compressorAllowed(connContext *ConnContext, compressor Compressor) bool {
+	enabled := false
+	for _, c := range server.compressors {
+		if c.ID() == compressor.ID() {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return false
+	}
+	for _, name := range connContext.Compression() {
+		if name == compressor.Name() {
+			return true
+		}
+	}
+	return false
+}
+
 func NewServer(port string) *Server {
 	return &Server{
-		Port:           port,
-		handlerMap:     make(map[OpCode]Handler),
-		defaultHandler: defaultHandler,
+		Port:                port,
+		handlerMap:          make(map[OpCode]Handler),
+		defaultHandler:      defaultHandler,
+		listeners:           make(map[net.Listener]struct{}),
+		conns:               make(map[*ConnContext]bool),
+		ops:                 make(map[int64]*Operation),
+		shutdownCh:          make(chan struct{}),
+		MaxMessageSizeBytes: DefaultMaxMessageSizeBytes,
+		MaxBsonObjectSize:   DefaultMaxBsonObjectSize,
+		compressors: []Compressor{
+			compressors[CompressorSnappy],
+			compressors[CompressorZlib],
+			compressors[CompressorZstd],
+		},
 	}
 }
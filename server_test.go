@@ -10,7 +10,9 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,12 +20,15 @@ import (
 func TestNewServer(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	logrus.SetReportCaller(true)
-	server := NewServer(`27018`)
+	server := NewServer(`0`)
 	server.AddHandler(OP_QUERY, &TestHandler{})
 	server.AddHandler(OP_MSG, &MsgHandler{})
-	e := server.Start(context.TODO())
+	//ctx结束时Start关闭所有监听并返回nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := server.Start(ctx)
 	if e != nil {
-		panic(e)
+		t.Fatal(e)
 	}
 }
 
@@ -168,8 +173,7 @@ func (t *TestHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) e
 
 func defaultReply(query *Query, w io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{"ok": 1}
+	reply.AddDocument(map[string]interface{}{"ok": 1})
 
 	e := reply.Write(w)
 	if e != nil {
@@ -181,8 +185,7 @@ func defaultReply(query *Query, w io.Writer) error {
 
 func serverStatus(query *Query, w io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{"you": "118.114.245.36:48780", "ok": 1}
+	reply.AddDocument(map[string]interface{}{"you": "118.114.245.36:48780", "ok": 1})
 
 	e := reply.Write(w)
 	if e != nil {
@@ -194,8 +197,7 @@ func serverStatus(query *Query, w io.Writer) error {
 
 func buildinfo(query *Query, w io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{
+	reply.AddDocument(map[string]interface{}{
 		"version":          "3.4.0",
 		"gitVersion":       "a4b751dcf51dd249c5865812b390cfd1c0129c30",
 		"modules":          make([]string, 0),
@@ -228,7 +230,7 @@ func buildinfo(query *Query, w io.Writer) error {
 			"wiredTiger",
 		},
 		"ok": 1,
-	}
+	})
 
 	e := reply.Write(w)
 	if e != nil {
@@ -240,8 +242,7 @@ func buildinfo(query *Query, w io.Writer) error {
 
 func whatsmyuri(query *Query, w io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{"you": "118.114.245.36:48780", "ok": 1}
+	reply.AddDocument(map[string]interface{}{"you": "118.114.245.36:48780", "ok": 1})
 
 	e := reply.Write(w)
 	if e != nil {
@@ -253,8 +254,7 @@ func whatsmyuri(query *Query, w io.Writer) error {
 
 func isMaster(query *Query, writer io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{
+	reply.AddDocument(map[string]interface{}{
 		"ismaster":                     true,
 		"maxBsonObjectSize":            16777216,
 		"maxMessageSizeBytes":          48000000,
@@ -266,7 +266,7 @@ func isMaster(query *Query, writer io.Writer) error {
 		"maxWireVersion":               3,
 		"readOnly":                     false,
 		"ok":                           1.0,
-	}
+	})
 
 	e := reply.Write(writer)
 	if e != nil {
@@ -278,8 +278,7 @@ func isMaster(query *Query, writer io.Writer) error {
 
 func listDatabase(query *Query, w io.Writer) error {
 	reply := NewReply(query.Header.RequestID)
-	reply.NumberReturned = 1
-	reply.Documents = map[string]interface{}{
+	reply.AddDocument(map[string]interface{}{
 		"totalSize": 274432,
 		"ok":        1,
 		"databases": []interface{}{
@@ -299,7 +298,7 @@ func listDatabase(query *Query, w io.Writer) error {
 				"empty":      false,
 			},
 		},
-	}
+	})
 	e := reply.Write(w)
 	if e != nil {
 		return e
@@ -312,3 +311,192 @@ func TestByteWrite(t *testing.T) {
 	_ = binary.Write(buffer, binary.LittleEndian, int32(10))
 	println(buffer.Len())
 }
+
+func TestStartStopsOnCancel(t *testing.T) {
+	server := NewServer(`0`)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Start(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case e := <-result:
+		if e != nil {
+			t.Fatal(e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after cancel")
+	}
+}
+
+func newShutdownTestServer(t *testing.T, started chan struct{}, release chan struct{}) (*Server, net.Listener, chan error) {
+	server := NewServer(`0`)
+	server.SetDefaultHandler(HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+		if _, e := ioutil.ReadAll(r); e != nil {
+			return e
+		}
+		close(started)
+		<-release
+		reply := NewMsgReply(header.RequestID)
+		section := NewBodyMsgSection()
+		section.Body = bson.M{"ok": 1.0}
+		reply.Sections = append(reply.Sections, section)
+		return reply.Write(conn)
+	}))
+	listener, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	return server, listener, served
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server, listener, served := newShutdownTestServer(t, started, release)
+	idle, e := net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer idle.Close()
+	busy, e := net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer busy.Close()
+	sendTestMsg(t, busy, 1, 0, bson.M{"slow": 1})
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	if e := <-served; e != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", e)
+	}
+	if _, e := idle.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected idle connection closed, got %v", e)
+	}
+	close(release)
+	if _, msg := readTestMsg(t, busy); msg.GetBodyMsgSection()["ok"] != 1.0 {
+		t.Fatalf("unexpected reply %v", msg.GetBodyMsgSection())
+	}
+	if e := <-shutdown; e != nil {
+		t.Fatal(e)
+	}
+	if _, e := busy.Read(make([]byte, 1)); e != io.EOF {
+		t.Fatalf("expected connection closed after drain, got %v", e)
+	}
+}
+
+/*
+已经开始读取的请求不会被当作空闲连接关闭
+*/
+func TestShutdownPartialRequest(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	close(release)
+	server, listener, _ := newShutdownTestServer(t, started, release)
+	client, e := net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer client.Close()
+	buffer := &bytes.Buffer{}
+	sendTestMsg(t, buffer, 1, 0, bson.D{{Name: "ping", Value: 1}})
+	if _, e := client.Write(buffer.Next(10)); e != nil {
+		t.Fatal(e)
+	}
+	//收到第一个字节后连接即为活跃状态
+	timeout := time.Now().Add(5 * time.Second)
+	for active := false; !active; time.Sleep(time.Millisecond) {
+		if time.Now().After(timeout) {
+			t.Fatal("connection was not marked active")
+		}
+		server.lock.Lock()
+		for _, v := range server.conns {
+			active = active || v
+		}
+		server.lock.Unlock()
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	//等待Shutdown关闭空闲连接
+	time.Sleep(5 * shutdownPollInterval)
+	if _, e := client.Write(buffer.Bytes()); e != nil {
+		t.Fatal(e)
+	}
+	if _, msg := readTestMsg(t, client); msg.GetBodyMsgSection()["ok"] != 1.0 {
+		t.Fatalf("unexpected reply %v", msg.GetBodyMsgSection())
+	}
+	if e := <-shutdown; e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	server := NewServer(`0`)
+	var closed int32
+	server.SetDefaultHandler(HandlerFunc(func(header *MsgHeader, r *Reader, conn *ConnContext) error {
+		if _, e := ioutil.ReadAll(r); e != nil {
+			return e
+		}
+		//连接关闭时的清理在连接从conns中移除之后才执行
+		conn.OnClose(func() {
+			time.Sleep(100 * time.Millisecond)
+			atomic.StoreInt32(&closed, 1)
+		})
+		reply := NewMsgReply(header.RequestID)
+		section := NewBodyMsgSection()
+		section.Body = bson.M{"ok": 1.0}
+		reply.Sections = append(reply.Sections, section)
+		return reply.Write(conn)
+	}))
+	listener := NewPipeListener()
+	go server.Serve(listener)
+	client, e := listener.Dial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer client.Close()
+	sendTestMsg(t, client, 1, 0, bson.D{{Name: "ping", Value: 1}})
+	readTestMsg(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e := server.Shutdown(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Fatal("Shutdown returned before the handler exited")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server, listener, _ := newShutdownTestServer(t, started, release)
+	busy, e := net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer busy.Close()
+	sendTestMsg(t, busy, 1, 0, bson.M{"slow": 1})
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if e := server.Shutdown(ctx); e != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", e)
+	}
+}
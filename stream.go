@@ -0,0 +1,71 @@
+package mongo_protocol
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrStreamClosed = errors.New("reply stream closed")
+
+var lastRequestID int32
+
+func nextRequestID() int32 {
+	return atomic.AddInt32(&lastRequestID, 1)
+}
+
+/*
+OP_MSG回复流,客户端设置exhaustAllowed时可以连续发送多个带moreToCome的回复,
+如 awaitable hello 与 exhaust cursor. 每个后续回复的responseTo是上一个回复的requestID
+*/
+type MsgStream struct {
+	conn       *ConnContext
+	responseTo int32
+	exhaust    bool
+	closed     bool
+}
+
+func NewMsgStream(header *MsgHeader, msg *Msg, conn *ConnContext) *MsgStream {
+	return &MsgStream{
+		conn:       conn,
+		responseTo: header.RequestID,
+		exhaust:    msg.FlatBits.Has(ExhaustAllowed),
+	}
+}
+
+/*
+是否允许发送多个回复
+*/
+func (s *MsgStream) Exhaust() bool {
+	return s.exhaust
+}
+
+/*
+发送一个回复,body可以是bson.M、bson.D、bson.Raw或其他可序列化的值;
+more表示后面还有回复,客户端未设置exhaustAllowed时more被忽略,发送后流即关闭
+*/
+func (s *MsgStream) Send(body interface{}, more bool) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	more = more && s.exhaust
+	reply := NewMsgReply(s.responseTo)
+	reply.Header.RequestID = nextRequestID()
+	if more {
+		reply.FlatBits.Set(MoreToCome)
+	}
+	section := NewBodyMsgSection()
+	if e := setReplyBody(section, body); e != nil {
+		return e
+	}
+	reply.Sections = append(reply.Sections, section)
+	if e := reply.Write(s.conn); e != nil {
+		s.closed = true
+		return e
+	}
+	if more {
+		s.responseTo = reply.Header.RequestID
+	} else {
+		s.closed = true
+	}
+	return nil
+}
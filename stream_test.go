@@ -0,0 +1,115 @@
+package mongo_protocol
+
+import (
+	"bytes"
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"testing"
+)
+
+type streamHandler struct {
+}
+
+func (h *streamHandler) Process(header *MsgHeader, r *Reader, conn *ConnContext) error {
+	msg := &Msg{}
+	if e := msg.UnMarshal(r); e != nil {
+		return e
+	}
+	stream := NewMsgStream(header, msg, conn)
+	for i := 0; i < 3; i++ {
+		var body interface{} = bson.D{{Name: "n", Value: i}, {Name: "ok", Value: 1.0}}
+		if i == 2 {
+			out, _ := bson.Marshal(body)
+			body = bson.Raw{Kind: bsonDocumentKind, Data: out}
+		}
+		if e := stream.Send(body, i < 2); e != nil {
+			if e == ErrStreamClosed {
+				return nil
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+func sendTestMsg(t *testing.T, w io.Writer, requestID int32, flags MsgFlags, body interface{}) {
+	request := &Msg{Header: &MsgHeader{RequestID: requestID}, FlatBits: flags}
+	section := NewBodyMsgSection()
+	if e := setReplyBody(section, body); e != nil {
+		t.Fatal(e)
+	}
+	request.Sections = append(request.Sections, section)
+	if e := request.Write(w); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func readTestMsg(t *testing.T, r io.Reader) (*MsgHeader, *Msg) {
+	header, body, e := readMessage(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	msg := &Msg{}
+	if e := msg.UnMarshal(&Reader{Reader: bytes.NewReader(body), Header: header}); e != nil {
+		t.Fatal(e)
+	}
+	return header, msg
+}
+
+func TestMsgStreamExhaust(t *testing.T) {
+	server := NewServer(`0`)
+	server.AddHandler(OP_MSG, &streamHandler{})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestMsg(t, client, 10, ExhaustAllowed, bson.M{"hello": 1})
+	responseTo := int32(10)
+	for i := 0; i < 3; i++ {
+		header, msg := readTestMsg(t, client)
+		if header.ResponseTo != responseTo {
+			t.Fatalf("reply %d: expected responseTo %d, got %d", i, responseTo, header.ResponseTo)
+		}
+		if msg.FlatBits.Has(MoreToCome) != (i < 2) {
+			t.Fatalf("reply %d: unexpected flags %b", i, msg.FlatBits)
+		}
+		var body bson.D
+		if e := msg.GetBodyMsgSectionRaw().Unmarshal(&body); e != nil || len(body) != 2 || body[0].Name != "n" || body[0].Value != i {
+			t.Fatalf("reply %d: unexpected body %v %v", i, body, e)
+		}
+		responseTo = header.RequestID
+	}
+}
+
+func TestMsgStreamWithoutExhaust(t *testing.T) {
+	server := NewServer(`0`)
+	server.AddHandler(OP_MSG, &streamHandler{})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	for _, id := range []int32{10, 11} {
+		sendTestMsg(t, client, id, 0, bson.M{"hello": 1})
+		header, msg := readTestMsg(t, client)
+		if header.ResponseTo != id || msg.FlatBits.Has(MoreToCome) {
+			t.Fatalf("unexpected reply %v flags %b", *header, msg.FlatBits)
+		}
+	}
+}
+
+func TestMoreToComeNoReply(t *testing.T) {
+	server := NewServer(`0`)
+	server.AddHandler(OP_MSG, &echoHandler{})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handler(context.TODO(), conn)
+
+	sendTestMsg(t, client, 20, MoreToCome, bson.M{"insert": "a"})
+	sendTestMsg(t, client, 21, 0, bson.M{"ping": 1})
+	header, _ := readTestMsg(t, client)
+	if header.ResponseTo != 21 {
+		t.Fatalf("expected reply to 21 only, got reply to %d", header.ResponseTo)
+	}
+}
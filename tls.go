@@ -0,0 +1,75 @@
+package mongo_protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+/*
+客户端证书的校验方式
+*/
+type ClientCertMode int
+
+const (
+	// 不请求客户端证书
+	ClientCertNone ClientCertMode = iota
+	// 客户端提供证书时使用CA校验
+	ClientCertOptional
+	// 客户端必须提供可以被CA校验的证书
+	ClientCertRequired
+)
+
+/*
+TLS配置,对应mongod的 --tlsCertificateKeyFile, --tlsCAFile 等参数
+*/
+type TLSConfig struct {
+	// PEM格式的服务端证书与私钥,KeyFile为空时私钥与证书在同一个文件中
+	CertFile string
+	KeyFile  string
+	// 校验客户端证书的CA,ClientCertMode不为ClientCertNone时必须设置
+	CAFile         string
+	ClientCertMode ClientCertMode
+	// 最低TLS版本,为0时使用tls.VersionTLS12
+	MinVersion uint16
+}
+
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	keyFile := c.KeyFile
+	if keyFile == "" {
+		keyFile = c.CertFile
+	}
+	cert, e := tls.LoadX509KeyPair(c.CertFile, keyFile)
+	if e != nil {
+		return nil, e
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   c.MinVersion,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if c.CAFile != "" {
+		pem, e := ioutil.ReadFile(c.CAFile)
+		if e != nil {
+			return nil, e
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.ClientCAs = pool
+	}
+	switch c.ClientCertMode {
+	case ClientCertOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequired:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, fmt.Errorf("client certificate verification requires CAFile")
+	}
+	return config, nil
+}
@@ -0,0 +1,201 @@
+package mongo_protocol
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, serial int64) *testCert {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, e := x509.ParseCertificate(der)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	keyDER, e := x509.MarshalECPrivateKey(c.key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if e := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir, e := ioutil.TempDir("", "mongo-tls")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "test-ca", nil, 1)
+	serverCert := newTestCert(t, "localhost", ca, 2)
+	clientCert := newTestCert(t, "app-user", ca, 3)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := serverCert.writeFiles(t, dir, "server")
+
+	server := NewServer(`0`)
+	if e := server.SetTLS(&TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, ClientCertMode: ClientCertRequired}); e != nil {
+		t.Fatal(e)
+	}
+	router := NewCommandRouter()
+	router.Handle("whoami", func(cmd *Command) (interface{}, error) {
+		certs := cmd.Conn.PeerCertificates()
+		if len(certs) == 0 {
+			return nil, NewCommandError(CodeUnauthorized, "no client certificate")
+		}
+		return bson.M{"user": certs[0].Subject.CommonName, "ok": 1.0}, nil
+	})
+	server.AddHandler(OP_MSG, router)
+	listener, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, e := tls.Dial(`tcp`, listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert.tlsCertificate()},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	client := NewClient(conn)
+	defer client.Close()
+	result, e := client.RunCommand(ctx, "admin", bson.D{{Name: "whoami", Value: 1}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result["user"] != "app-user" {
+		t.Fatalf("unexpected result %v", result)
+	}
+
+	conn, e = tls.Dial(`tcp`, listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if e == nil {
+		// TLS 1.3的客户端在握手完成后才会收到服务端拒绝证书的alert
+		_, e = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if e == nil {
+		t.Fatal("expected handshake without client certificate to fail")
+	}
+}
+
+func TestTLSConfigRequiresCA(t *testing.T) {
+	dir, e := ioutil.TempDir("", "mongo-tls")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := newTestCert(t, "localhost", nil, 1).writeFiles(t, dir, "server")
+	if _, e := (&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCertMode: ClientCertOptional}).Build(); e == nil {
+		t.Fatal("expected error without CAFile")
+	}
+	config, e := (&TLSConfig{CertFile: certFile, KeyFile: keyFile}).Build()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected config %v %v", config.ClientAuth, config.MinVersion)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, 1)
+	serverCert := newTestCert(t, "localhost", ca, 2)
+	server := NewServer(`0`)
+	server.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate()}})
+	server.TLSHandshakeTimeout = 100 * time.Millisecond
+	listener, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	go server.Serve(listener)
+
+	//不发送ClientHello的连接在超时后被关闭
+	stalled, e := net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer stalled.Close()
+	expectClosed(t, stalled)
+	waitStats(t, server, func(stats ServerStats) bool {
+		return stats.DroppedReadTimeout == 1 && stats.Connections == 0
+	})
+
+	//握手中的连接对Shutdown可见,会被当作空闲连接关闭
+	server.TLSHandshakeTimeout = time.Hour
+	stalled, e = net.Dial(`tcp`, listener.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer stalled.Close()
+	waitStats(t, server, func(stats ServerStats) bool {
+		return stats.Connections == 1
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if e := server.Shutdown(ctx); e != nil {
+		t.Fatal(e)
+	}
+	expectClosed(t, stalled)
+}